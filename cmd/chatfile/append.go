@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+	chatfile "github.com/vorotynsky/chatfile/lib"
+)
+
+// answer is a reply appended to a chatfile.
+type answer struct {
+	content    string
+	thought    string
+	attributes chatfile.Attributes
+}
+
+// timeFormat is the format of the time attribute of appended answers.
+const timeFormat = "2006-01-02T15:04Z"
+
+// newAnswers prepares the choices of a response for appending, with attributes telling where they come from:
+// the model, the time, the completion tokens of a single answer, and the finish reason unless it is stop.
+func newAnswers(request *request, response response, thoughts bool) []answer {
+	answers := make([]answer, len(response.choices))
+	for i, content := range response.choices {
+		attributes := chatfile.Attributes{
+			"model": string(request.Model),
+			"time":  time.Now().UTC().Format(timeFormat),
+		}
+		if len(response.choices) == 1 && response.usage.CompletionTokens > 0 {
+			attributes["tokens"] = strconv.Itoa(response.usage.CompletionTokens)
+		}
+		if reason := response.reasons[i]; reason != "" && reason != string(openai.FinishReasonStop) {
+			attributes["finish"] = reason
+		}
+
+		answers[i] = answer{content: content, attributes: attributes}
+		if thoughts {
+			answers[i].thought = response.thoughts[i]
+		}
+	}
+	return answers
+}
+
+// interruptedAttribute marks answers saved after the request was interrupted.
+const interruptedAttribute = "interrupted"
+
+// appendInterrupted saves the partial answers received before an interrupt, marked with [interruptedAttribute].
+// Nothing is saved unless every answer has started, so the saved ones keep their CHOICE indices.
+func appendInterrupted(path string, prompts []chatfile.Command, answers []answer) error {
+	for i := range answers {
+		if answers[i].content == "" {
+			return nil
+		}
+		answers[i].content = strings.TrimRight(answers[i].content, " \n")
+		answers[i].attributes[interruptedAttribute] = ""
+	}
+
+	if err := appendAnswers(path, prompts, answers); err != nil {
+		return fmt.Errorf("appending partial answer: %w", err)
+	}
+
+	fmt.Fprintf(os.Stderr, "\nPartial answer saved to %s\n", path)
+	return nil
+}
+
+// continuation returns the commands to append before the answers to a request, so they extend its branch:
+// CONTINUE FROM a label when it is not the branch written last, followed by the questions the chatfile lacks.
+// Branches that cannot be extended by appending are reported before the request is sent.
+func continuation(request *request, questions []chatfile.Command) ([]chatfile.Command, error) {
+	command, err := request.Context.Continuation()
+	if err != nil {
+		return nil, fmt.Errorf("appending answer: %w, add a LABEL there to continue it", err)
+	}
+	if command == nil {
+		return questions, nil
+	}
+	return append([]chatfile.Command{command}, questions...), nil
+}
+
+// appendAnswers adds the answer to the end of a chatfile, starting a new line if needed.
+// The prompts go first: they were sent with the request but are missing from the chatfile.
+// Several answers are each preceded by CHOICE with their index.
+// Non-empty thoughts are written as THOUGHT before the answers they belong to.
+func appendAnswers(path string, prompts []chatfile.Command, answers []answer) error {
+	commands := slices.Clone(prompts)
+	for i, answer := range answers {
+		if len(answers) > 1 {
+			commands = append(commands, &chatfile.ChoiceCommand{Index: i + 1})
+		}
+		if thought := strings.TrimSpace(answer.thought); thought != "" {
+			commands = append(commands, &chatfile.ThoughtCommand{Thought: thought})
+		}
+		commands = append(commands, &chatfile.PromptCommand{Role: chatfile.RoleAssistant, Message: answer.content, Attributes: answer.attributes})
+	}
+
+	return appendCommands(path, commands)
+}
+
+// appendCommands writes commands to the end of a chatfile, starting a new line if needed.
+// Nothing is written when one of them cannot be encoded.
+func appendCommands(path string, commands []chatfile.Command) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var text strings.Builder
+	if len(content) > 0 && content[len(content)-1] != '\n' {
+		text.WriteString("\n")
+	}
+
+	encoder := chatfile.NewEncoder(&text)
+	for _, command := range commands {
+		if err = encoder.Encode(command); err != nil {
+			return err
+		}
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.WriteString(text.String())
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
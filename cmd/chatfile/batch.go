@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	chatfile "github.com/vorotynsky/chatfile/lib"
+)
+
+type BatchCmd struct {
+	Files []string `arg:"positional, required" placeholder:"PATTERN" help:"chatfiles, glob patterns or directories to search for chatfiles"`
+
+	Jobs   int  `arg:"-j,--jobs" default:"4" placeholder:"N" help:"Number of chatfiles run concurrently"`
+	RPM    int  `arg:"--rpm" placeholder:"N" help:"Limit of requests per minute to every model of a provider"`
+	TPM    int  `arg:"--tpm" placeholder:"N" help:"Limit of tokens per minute to every model of a provider, counting prompts and --max-tokens"`
+	Append bool `arg:"--append" help:"Append responses to the chatfiles as ANSWER instead of writing <file>.out"`
+
+	RequestOptions
+}
+
+// batchResult is the outcome of running a single chatfile.
+type batchResult struct {
+	path     string
+	err      error
+	duration time.Duration
+}
+
+func (cmd BatchCmd) Execute() {
+	paths, err := expandChatfiles(cmd.Files)
+	if err != nil {
+		exitWithError("Error searching chatfiles:", err)
+	}
+	if len(paths) == 0 {
+		exitWithError("Error:", fmt.Errorf("no chatfiles found"))
+	}
+
+	runner := newRunner(cmd.RequestOptions)
+	limits := newRateLimits(cmd.RPM, cmd.TPM)
+	progress := newProgress(len(paths))
+
+	jobs := make(chan string)
+	results := make(chan batchResult)
+
+	var workers sync.WaitGroup
+	for range max(cmd.Jobs, 1) {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for path := range jobs {
+				start := time.Now()
+				err := cmd.run(runner, limits, path)
+				results <- batchResult{path, err, time.Since(start)}
+			}
+		}()
+	}
+
+	go func() {
+		for _, path := range paths {
+			jobs <- path
+		}
+		close(jobs)
+		workers.Wait()
+		close(results)
+	}()
+
+	var failed []batchResult
+	for result := range results {
+		progress.done(result)
+		if result.err != nil {
+			failed = append(failed, result)
+		}
+	}
+	progress.finish()
+
+	if len(failed) > 0 {
+		fmt.Fprintf(os.Stderr, "%d of %d chatfiles failed:\n", len(failed), len(paths))
+		for _, result := range failed {
+			fmt.Fprintf(os.Stderr, "  %s: %v\n", result.path, result.err)
+		}
+		os.Exit(1)
+	}
+}
+
+func (cmd BatchCmd) run(runner *runner, limits *rateLimits, path string) error {
+	request, err := runner.prepare(context.Background(), path, overrides{})
+	if err != nil {
+		return err
+	}
+
+	request.Params.IncludeUsage = cmd.Append
+
+	var prompts []chatfile.Command
+	if cmd.Append {
+		if prompts, err = continuation(request, nil); err != nil {
+			return err
+		}
+	}
+
+	limits.endpoint(runner.options.BaseUrl, request.Model).wait(request.tokens)
+
+	var output strings.Builder
+	response, err := runner.send(context.Background(), request, &output, layoutSequential)
+	if err != nil {
+		return err
+	}
+
+	if cmd.Append {
+		return appendAnswers(path, prompts, newAnswers(request, response, false))
+	}
+	return os.WriteFile(path+".out", []byte(output.String()), 0666)
+}
+
+// expandChatfiles resolves glob patterns and walks directories.
+// Directories contribute files named chatfile or having the .chatfile extension.
+func expandChatfiles(patterns []string) ([]string, error) {
+	var paths []string
+	seen := make(map[string]bool)
+
+	add := func(path string) {
+		if !seen[path] {
+			seen[path] = true
+			paths = append(paths, path)
+		}
+	}
+
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		if matches == nil {
+			return nil, fmt.Errorf("%s: %w", pattern, fs.ErrNotExist)
+		}
+
+		for _, match := range matches {
+			info, err := os.Stat(match)
+			if err != nil {
+				return nil, err
+			}
+
+			if !info.IsDir() {
+				add(match)
+				continue
+			}
+
+			err = filepath.WalkDir(match, func(path string, d fs.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				if !d.IsDir() && (d.Name() == "chatfile" || filepath.Ext(path) == ".chatfile") {
+					add(path)
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return paths, nil
+}
+
+// rateLimits holds a limiter for every endpoint a request is sent to: a model of a provider,
+// as providers count requests and tokens of every model separately.
+type rateLimits struct {
+	mu       sync.Mutex
+	rpm, tpm int
+	limiters map[endpoint]*rateLimiter
+}
+
+// endpoint is a model of the provider at a base URL, empty for the default one.
+type endpoint struct {
+	baseURL string
+	model   chatfile.ModelName
+}
+
+func newRateLimits(rpm int, tpm int) *rateLimits {
+	return &rateLimits{rpm: rpm, tpm: tpm, limiters: make(map[endpoint]*rateLimiter)}
+}
+
+// endpoint returns the limiter of the model of a document sent to the provider at the base URL.
+func (l *rateLimits) endpoint(baseURL string, model chatfile.ModelName) *rateLimiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := endpoint{baseURL, model}
+	limiter, found := l.limiters[key]
+	if !found {
+		limiter = newRateLimiter(l.rpm, l.tpm)
+		l.limiters[key] = limiter
+	}
+	return limiter
+}
+
+// rateLimiter keeps requests and tokens sent to a provider within per-minute limits.
+// A zero limit disables the corresponding check.
+type rateLimiter struct {
+	mu       sync.Mutex
+	rpm, tpm int
+	sent     []sentRequest
+}
+
+type sentRequest struct {
+	at     time.Time
+	tokens int
+}
+
+func newRateLimiter(rpm int, tpm int) *rateLimiter {
+	return &rateLimiter{rpm: rpm, tpm: tpm}
+}
+
+// wait blocks until a request of the given size can be sent and records it.
+// A request larger than the token limit is sent alone, once the last minute is empty.
+func (l *rateLimiter) wait(tokens int) {
+	for {
+		l.mu.Lock()
+
+		now := time.Now()
+		for len(l.sent) > 0 && now.Sub(l.sent[0].at) >= time.Minute {
+			l.sent = l.sent[1:]
+		}
+
+		used := 0
+		for _, request := range l.sent {
+			used += request.tokens
+		}
+
+		fitsRequests := l.rpm <= 0 || len(l.sent) < l.rpm
+		fitsTokens := l.tpm <= 0 || used+tokens <= l.tpm || len(l.sent) == 0
+
+		if fitsRequests && fitsTokens {
+			l.sent = append(l.sent, sentRequest{now, tokens})
+			l.mu.Unlock()
+			return
+		}
+
+		delay := time.Minute - now.Sub(l.sent[0].at)
+		l.mu.Unlock()
+		time.Sleep(delay)
+	}
+}
+
+// progress reports finished chatfiles to stderr, keeping a status line when it is a terminal.
+type progress struct {
+	total    int
+	finished int
+	tty      bool
+}
+
+func newProgress(total int) *progress {
+	p := &progress{total: total, tty: isTerminal(os.Stderr)}
+	p.status()
+	return p
+}
+
+func (p *progress) done(result batchResult) {
+	p.finished++
+
+	if p.tty {
+		fmt.Fprint(os.Stderr, "\r\033[K")
+	}
+
+	state := "ok"
+	if result.err != nil {
+		state = "FAIL"
+	}
+	fmt.Fprintf(os.Stderr, "[%d/%d] %-4s %s (%s)\n", p.finished, p.total, state, result.path, result.duration.Round(time.Millisecond))
+
+	p.status()
+}
+
+func (p *progress) status() {
+	if p.tty && p.finished < p.total {
+		fmt.Fprintf(os.Stderr, "running... %d/%d done", p.finished, p.total)
+	}
+}
+
+func (p *progress) finish() {
+	if p.tty {
+		fmt.Fprint(os.Stderr, "\r\033[K")
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	layoutSequential = "sequential"
+	layoutColumns    = "columns"
+)
+
+// writeChoices shows several completions one after another with separators, or side by side in columns.
+func writeChoices(writer io.StringWriter, choices []string, layout string) error {
+	switch layout {
+	case layoutSequential:
+		for i, choice := range choices {
+			text := fmt.Sprintf("--- choice %d ---\n%s\n", i+1, strings.TrimRight(choice, "\n"))
+			if i > 0 {
+				text = "\n" + text
+			}
+			if _, err := writer.WriteString(text); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case layoutColumns:
+		headers := make([]string, len(choices))
+		for i := range choices {
+			headers[i] = fmt.Sprintf("choice %d", i+1)
+		}
+		return writeColumns(writer, headers, choices)
+	}
+
+	return fmt.Errorf("unknown layout %q, expected %s or %s", layout, layoutSequential, layoutColumns)
+}
+
+// writeColumns puts texts side by side, wrapped to share the width of the terminal.
+func writeColumns(writer io.StringWriter, headers []string, texts []string) error {
+	const separator = " │ "
+
+	width, err := strconv.Atoi(os.Getenv("COLUMNS"))
+	if err != nil || width <= 0 {
+		width = 120
+	}
+	columnWidth := max((width-len([]rune(separator))*(len(texts)-1))/len(texts), 10)
+
+	columns := make([][]string, len(texts))
+	rows := 0
+	for i, text := range texts {
+		columns[i] = append(wrap(headers[i], columnWidth), strings.Repeat("─", columnWidth))
+		columns[i] = append(columns[i], wrap(text, columnWidth)...)
+		rows = max(rows, len(columns[i]))
+	}
+
+	for row := 0; row < rows; row++ {
+		cells := make([]string, len(columns))
+		for i, column := range columns {
+			cell := ""
+			if row < len(column) {
+				cell = column[row]
+			}
+			cells[i] = cell + strings.Repeat(" ", columnWidth-len([]rune(cell)))
+		}
+
+		if _, err := writer.WriteString(strings.TrimRight(strings.Join(cells, separator), " ") + "\n"); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// wrap breaks text into lines of at most width runes, splitting at spaces where possible.
+func wrap(text string, width int) (lines []string) {
+	for _, paragraph := range strings.Split(strings.TrimRight(text, "\n"), "\n") {
+		line := []rune{}
+		for _, word := range strings.Fields(paragraph) {
+			runes := []rune(word)
+			if len(line) > 0 && len(line)+1+len(runes) > width {
+				lines = append(lines, string(line))
+				line = line[:0]
+			}
+			if len(line) > 0 {
+				line = append(line, ' ')
+			}
+			line = append(line, runes...)
+
+			for len(line) > width {
+				lines = append(lines, string(line[:width]))
+				line = append([]rune{}, line[width:]...)
+			}
+		}
+		lines = append(lines, string(line))
+	}
+	return
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	chatfile "github.com/vorotynsky/chatfile/lib"
+)
+
+const (
+	formatColumns  = "columns"
+	formatMarkdown = "markdown"
+	formatJson     = "json"
+)
+
+type CompareCmd struct {
+	File   string   `arg:"positional, required, help:open a specified file as a chatfile"`
+	Models []string `arg:"--models,required,separate" placeholder:"MODEL,..." help:"Comma separated models to run the chatfile against, replacing its FROM"`
+	Format string   `arg:"--format" default:"columns" placeholder:"FORMAT" help:"Output format: columns, markdown or json"`
+
+	RequestOptions
+}
+
+// comparison is the outcome of running the chatfile against one model.
+type comparison struct {
+	Model   chatfile.ModelName `json:"model"`
+	Latency time.Duration      `json:"-"`
+	Usage   chatfile.Usage     `json:"usage"`
+	Content string             `json:"content"`
+	Err     error              `json:"-"`
+}
+
+func (c comparison) MarshalJSON() ([]byte, error) {
+	type plain comparison
+	var errText string
+	if c.Err != nil {
+		errText = c.Err.Error()
+	}
+
+	return json.Marshal(struct {
+		plain
+		LatencyMs int64  `json:"latency_ms"`
+		Error     string `json:"error,omitempty"`
+	}{plain(c), c.Latency.Milliseconds(), errText})
+}
+
+func (cmd CompareCmd) Execute() {
+	var models []chatfile.ModelName
+	for _, list := range cmd.Models {
+		for _, model := range strings.Split(list, ",") {
+			if model = strings.TrimSpace(model); model != "" {
+				models = append(models, chatfile.ModelName(model))
+			}
+		}
+	}
+
+	// Both are checked before sending, as every model costs a request.
+	if !slices.Contains([]string{formatColumns, formatMarkdown, formatJson}, cmd.Format) {
+		exitWithError("Error:", fmt.Errorf("unknown format %q, expected %s, %s or %s", cmd.Format, formatColumns, formatMarkdown, formatJson))
+	}
+	if len(models) == 0 {
+		exitWithError("Error:", errors.New("--models lists no models to compare"))
+	}
+
+	runner := newRunner(cmd.RequestOptions)
+	results := make([]comparison, len(models))
+
+	var wg sync.WaitGroup
+	for i, model := range models {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = cmd.run(runner, model)
+		}()
+	}
+	wg.Wait()
+
+	var err error
+	switch cmd.Format {
+	case formatColumns:
+		headers := make([]string, len(results))
+		texts := make([]string, len(results))
+		for i, result := range results {
+			headers[i] = fmt.Sprintf("%s\n%s", result.Model, result.summary())
+			texts[i] = result.text()
+		}
+		err = writeColumns(os.Stdout, headers, texts)
+
+	case formatMarkdown:
+		for i, result := range results {
+			if i > 0 {
+				fmt.Println()
+			}
+			fmt.Printf("## %s\n\n_%s_\n\n%s\n", result.Model, result.summary(), strings.TrimRight(result.text(), "\n"))
+		}
+
+	case formatJson:
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(results)
+	}
+
+	if err != nil {
+		exitWithError("Error writing comparison:", err)
+	}
+
+	for _, result := range results {
+		if result.Err != nil {
+			os.Exit(1)
+		}
+	}
+}
+
+func (cmd CompareCmd) run(runner *runner, model chatfile.ModelName) comparison {
+	result := comparison{Model: model}
+	start := time.Now()
+
+	request, err := runner.prepare(context.Background(), cmd.File, overrides{model: model})
+	if err == nil {
+		request.Params.IncludeUsage = true
+
+		var output strings.Builder
+		var response response
+		response, err = runner.send(context.Background(), request, &output, layoutSequential)
+		result.Content, result.Usage = output.String(), response.usage
+	}
+
+	result.Latency, result.Err = time.Since(start), err
+	return result
+}
+
+func (c comparison) summary() string {
+	if c.Err != nil {
+		return "failed"
+	}
+	return fmt.Sprintf("%s, %d prompt + %d completion tokens", c.Latency.Round(time.Millisecond), c.Usage.PromptTokens, c.Usage.CompletionTokens)
+}
+
+func (c comparison) text() string {
+	if c.Err != nil {
+		return "Error: " + c.Err.Error()
+	}
+	return c.Content
+}
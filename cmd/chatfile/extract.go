@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	chatfile "github.com/vorotynsky/chatfile/lib"
+)
+
+// extensions of files extracted from code blocks without a file name, by language.
+var extensions = map[string]string{
+	"go": "go", "golang": "go",
+	"python": "py", "py": "py",
+	"javascript": "js", "js": "js", "jsx": "jsx",
+	"typescript": "ts", "ts": "ts", "tsx": "tsx",
+	"sh": "sh", "bash": "sh", "shell": "sh", "zsh": "sh",
+	"rust": "rs", "rs": "rs",
+	"c": "c", "cpp": "cpp", "c++": "cpp", "java": "java", "kotlin": "kt", "cs": "cs", "csharp": "cs",
+	"ruby": "rb", "php": "php", "swift": "swift",
+	"html": "html", "css": "css", "sql": "sql",
+	"json": "json", "yaml": "yaml", "yml": "yaml", "toml": "toml", "xml": "xml",
+	"markdown": "md", "md": "md", "dockerfile": "Dockerfile", "makefile": "Makefile",
+}
+
+// extractFiles writes the code blocks of every choice to files in the directory.
+// Several choices are extracted into subdirectories named after them.
+// Blocks are named by the file name of their info string, or by their index when it is missing or leads outside the directory.
+func extractFiles(dir string, choices []string) error {
+	for i, choice := range choices {
+		target := dir
+		if len(choices) > 1 {
+			target = filepath.Join(dir, fmt.Sprintf("choice-%d", i+1))
+		}
+
+		for n, block := range chatfile.ExtractCodeBlocks(choice) {
+			name := filepath.FromSlash(block.FileName())
+			if name != "" && !filepath.IsLocal(name) {
+				fmt.Fprintf(os.Stderr, "Ignoring file name %s of code block %d outside of %s\n", name, n+1, target)
+				name = ""
+			}
+			if name == "" {
+				name = blockFileName(block, n)
+			}
+
+			path := filepath.Join(target, name)
+			if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+				return err
+			}
+			if err := os.WriteFile(path, []byte(strings.TrimRight(block.Content, "\n")+"\n"), 0666); err != nil {
+				return err
+			}
+			fmt.Fprintln(os.Stderr, "Extracted", path)
+		}
+	}
+
+	return nil
+}
+
+func blockFileName(block chatfile.CodeBlock, index int) string {
+	extension, found := extensions[block.Language]
+	if !found {
+		extension = "txt"
+	}
+
+	if extension == "Dockerfile" || extension == "Makefile" {
+		return fmt.Sprintf("%s-%d", extension, index+1)
+	}
+	return fmt.Sprintf("block-%d.%s", index+1, extension)
+}
+
+// writeCode prints only the contents of the code blocks of every choice, separated by blank lines.
+func writeCode(choices []string) error {
+	var blocks []string
+	for _, choice := range choices {
+		for _, block := range chatfile.ExtractCodeBlocks(choice) {
+			blocks = append(blocks, strings.TrimRight(block.Content, "\n"))
+		}
+	}
+
+	if len(blocks) == 0 {
+		return nil
+	}
+
+	_, err := fmt.Println(strings.Join(blocks, "\n\n"))
+	return err
+}
@@ -1,14 +1,38 @@
 package main
 
-import "github.com/alexflint/go-arg"
+import (
+	"github.com/alexflint/go-arg"
+)
+
+// commands are the subcommands of the command line.
+type commands struct {
+	Run     *RunCmd     `arg:"subcommand:run" help:"Run a chatfile"`
+	Tokens  *TokensCmd  `arg:"subcommand:tokens" help:"Count the tokens of a chatfile offline"`
+	Batch   *BatchCmd   `arg:"subcommand:batch" help:"Run many chatfiles concurrently"`
+	Test    *TestCmd    `arg:"subcommand:test" help:"Run chatfiles repeatedly and check their EXPECT assertions"`
+	Compare *CompareCmd `arg:"subcommand:compare" help:"Run a chatfile against several models"`
+	Serve   *ServeCmd   `arg:"subcommand:serve" help:"Serve the chatfiles of a directory over HTTP"`
+	Proxy   *ProxyCmd   `arg:"subcommand:proxy" help:"Proxy the OpenAI API, providing chatfiles as models"`
+}
 
 func main() {
-	var args struct {
-		Run *RunCmd `arg:"subcommand:run" help:"Run a chatfile"`
-	}
+	var args commands
 	arg.MustParse(&args)
 
-	if args.Run != nil {
+	switch {
+	case args.Run != nil:
 		args.Run.Execute()
+	case args.Tokens != nil:
+		args.Tokens.Execute()
+	case args.Batch != nil:
+		args.Batch.Execute()
+	case args.Test != nil:
+		args.Test.Execute()
+	case args.Compare != nil:
+		args.Compare.Execute()
+	case args.Serve != nil:
+		args.Serve.Execute()
+	case args.Proxy != nil:
+		args.Proxy.Execute()
 	}
 }
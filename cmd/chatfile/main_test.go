@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/alexflint/go-arg"
+)
+
+func parseCommands(t *testing.T, arguments ...string) commands {
+	t.Setenv("OPENAI_API_KEY", "test")
+
+	var args commands
+	parser, err := arg.NewParser(arg.Config{}, &args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = parser.Parse(arguments); err != nil {
+		t.Fatal(err)
+	}
+	return args
+}
+
+func TestTestCompletionsAndRuns(t *testing.T) {
+	args := parseCommands(t, "test", "--n", "3", "-r", "2", "prompts")
+
+	if args.Test == nil || args.Test.N == nil || *args.Test.N != 3 {
+		t.Fatalf("--n did not set the completions of test: %+v", args.Test)
+	}
+	if args.Test.Runs != 2 {
+		t.Errorf("runs %d, expected 2", args.Test.Runs)
+	}
+
+	if args = parseCommands(t, "test", "--n", "3", "prompts"); args.Test.Runs != 1 {
+		t.Errorf("--n set the runs to %d", args.Test.Runs)
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"io"
+	"regexp"
+	"strings"
+)
+
+const (
+	ansiReset     = "\033[0m"
+	ansiBold      = "\033[1m"
+	ansiDim       = "\033[2m"
+	ansiItalic    = "\033[3m"
+	ansiUnderline = "\033[4m"
+	ansiRed       = "\033[31m"
+	ansiGreen     = "\033[32m"
+	ansiYellow    = "\033[33m"
+	ansiBlue      = "\033[34m"
+	ansiMagenta   = "\033[35m"
+	ansiCyan      = "\033[36m"
+)
+
+// markdownWriter renders streamed Markdown with ANSI styles.
+// Lines are rendered once they are complete, as the style of a line depends on its beginning and its end.
+type markdownWriter struct {
+	writer  io.Writer
+	pending strings.Builder
+
+	// fence and language of the code block being written, if any.
+	fence    string
+	language string
+}
+
+func newMarkdownWriter(writer io.Writer) *markdownWriter {
+	return &markdownWriter{writer: writer}
+}
+
+func (m *markdownWriter) WriteString(s string) (int, error) {
+	for {
+		line, rest, complete := strings.Cut(s, "\n")
+		if !complete {
+			m.pending.WriteString(line)
+			return len(s), nil
+		}
+
+		m.pending.WriteString(line)
+		if err := m.writeLine(); err != nil {
+			return 0, err
+		}
+		s = rest
+	}
+}
+
+// Flush renders the last line when it does not end with a newline.
+func (m *markdownWriter) Flush() error {
+	if m.pending.Len() == 0 {
+		return nil
+	}
+
+	line := m.render(m.pending.String())
+	m.pending.Reset()
+	_, err := io.WriteString(m.writer, line)
+	return err
+}
+
+func (m *markdownWriter) writeLine() error {
+	line := m.render(m.pending.String())
+	m.pending.Reset()
+	_, err := io.WriteString(m.writer, line+"\n")
+	return err
+}
+
+var (
+	fencePattern   = regexp.MustCompile("^\\s*(```+|~~~+)\\s*([\\w+#-]*)")
+	headingPattern = regexp.MustCompile(`^(#{1,6})\s+(.*)$`)
+	bulletPattern  = regexp.MustCompile(`^(\s*)[-*+]\s+(.*)$`)
+	numberPattern  = regexp.MustCompile(`^(\s*)(\d+[.)])\s+(.*)$`)
+	rulePattern    = regexp.MustCompile(`^\s*([-*_])(\s*([-*_]))*\s*$`)
+	quotePattern   = regexp.MustCompile(`^\s*>\s?(.*)$`)
+)
+
+func (m *markdownWriter) render(line string) string {
+	if m.fence != "" {
+		if strings.HasPrefix(strings.TrimSpace(line), m.fence) {
+			m.fence, m.language = "", ""
+			return ansiDim + line + ansiReset
+		}
+		return highlight(line, m.language)
+	}
+
+	if match := fencePattern.FindStringSubmatch(line); match != nil {
+		m.fence, m.language = match[1], strings.ToLower(match[2])
+		return ansiDim + line + ansiReset
+	}
+
+	if match := headingPattern.FindStringSubmatch(line); match != nil {
+		style := ansiBold + ansiMagenta
+		if len(match[1]) == 1 {
+			style += ansiUnderline
+		}
+		return style + match[2] + ansiReset
+	}
+
+	if strings.Count(line, "-")+strings.Count(line, "*")+strings.Count(line, "_") >= 3 && rulePattern.MatchString(line) {
+		return ansiDim + strings.Repeat("─", 40) + ansiReset
+	}
+
+	if match := quotePattern.FindStringSubmatch(line); match != nil {
+		return ansiDim + "│ " + ansiReset + ansiItalic + inline(match[1]) + ansiReset
+	}
+
+	if match := bulletPattern.FindStringSubmatch(line); match != nil {
+		return match[1] + ansiCyan + "• " + ansiReset + inline(match[2])
+	}
+
+	if match := numberPattern.FindStringSubmatch(line); match != nil {
+		return match[1] + ansiCyan + match[2] + ansiReset + " " + inline(match[3])
+	}
+
+	return inline(line)
+}
+
+var inlinePattern = regexp.MustCompile("`[^`]+`|\\*\\*[^*]+\\*\\*|__[^_]+__|\\*[^*\\s][^*]*\\*|\\[[^\\]]+\\]\\([^)]+\\)")
+
+// inline styles code spans, strong and emphasized text and links.
+func inline(text string) string {
+	return inlinePattern.ReplaceAllStringFunc(text, func(span string) string {
+		switch {
+		case strings.HasPrefix(span, "`"):
+			return ansiYellow + strings.Trim(span, "`") + ansiReset
+		case strings.HasPrefix(span, "**"), strings.HasPrefix(span, "__"):
+			return ansiBold + span[2:len(span)-2] + ansiReset
+		case strings.HasPrefix(span, "*"):
+			return ansiItalic + span[1:len(span)-1] + ansiReset
+		default:
+			label, url, _ := strings.Cut(span[1:len(span)-1], "](")
+			return ansiUnderline + ansiBlue + label + ansiReset + ansiDim + " (" + url + ")" + ansiReset
+		}
+	})
+}
+
+// syntax describes a language for highlighting, line by line.
+type syntax struct {
+	keywords   map[string]bool
+	comment    string
+	ignoreCase bool
+}
+
+func words(list string) map[string]bool {
+	set := make(map[string]bool)
+	for _, word := range strings.Fields(list) {
+		set[word] = true
+	}
+	return set
+}
+
+var (
+	goSyntax     = syntax{words("break case chan const continue default defer else fallthrough for func go goto if import interface map package range return select struct switch type var nil true false"), "//", false}
+	pythonSyntax = syntax{words("and as assert async await break class continue def del elif else except finally for from global if import in is lambda nonlocal not or pass raise return try while with yield None True False"), "#", false}
+	jsSyntax     = syntax{words("async await break case catch class const continue default delete do else export extends finally for from function if import in instanceof let new of return switch this throw try typeof var void while yield null undefined true false interface type enum"), "//", false}
+	shellSyntax  = syntax{words("if then else elif fi for while until do done case esac in function return local export echo exit"), "#", false}
+	rustSyntax   = syntax{words("as async await break const continue crate else enum extern false fn for if impl in let loop match mod move mut pub ref return self Self static struct super trait true type unsafe use where while"), "//", false}
+	cSyntax      = syntax{words("auto break case char class const continue default do double else enum extern float for goto if int long new private protected public return short signed sizeof static struct switch this throw try typedef union unsigned void volatile while null true false"), "//", false}
+	sqlSyntax    = syntax{words("select from where and or not insert into values update set delete create table drop alter join left right inner outer on group by order having limit as null is in like distinct union"), "--", true}
+	yamlSyntax   = syntax{words("true false null"), "#", false}
+	jsonSyntax   = syntax{words("true false null"), "", false}
+)
+
+var syntaxes = map[string]syntax{
+	"go": goSyntax, "golang": goSyntax,
+	"python": pythonSyntax, "py": pythonSyntax,
+	"javascript": jsSyntax, "js": jsSyntax, "typescript": jsSyntax, "ts": jsSyntax, "jsx": jsSyntax, "tsx": jsSyntax,
+	"sh": shellSyntax, "bash": shellSyntax, "shell": shellSyntax, "zsh": shellSyntax, "console": shellSyntax,
+	"rust": rustSyntax, "rs": rustSyntax,
+	"c": cSyntax, "cpp": cSyntax, "c++": cSyntax, "java": cSyntax, "cs": cSyntax, "csharp": cSyntax, "kotlin": cSyntax,
+	"sql":  sqlSyntax,
+	"yaml": yamlSyntax, "yml": yamlSyntax, "toml": yamlSyntax, "json": jsonSyntax,
+}
+
+var codeToken = regexp.MustCompile(`"(\\.|[^"\\])*"?|'(\\.|[^'\\])*'?|` + "`[^`]*`?" + `|\b\d[\d_.xXa-fA-F]*\b|[A-Za-z_][\w]*|\S`)
+
+// highlight colors keywords, strings, numbers and comments of a code line.
+// Constructs spanning several lines, such as block comments, are not recognized.
+func highlight(line string, language string) string {
+	lang, known := syntaxes[language]
+
+	var builder strings.Builder
+	position := 0
+	for _, match := range codeToken.FindAllStringIndex(line, -1) {
+		builder.WriteString(line[position:match[0]])
+		token := line[match[0]:match[1]]
+		position = match[1]
+
+		if known && lang.comment != "" && strings.HasPrefix(line[match[0]:], lang.comment) {
+			builder.WriteString(ansiDim + line[match[0]:] + ansiReset)
+			return builder.String()
+		}
+
+		switch {
+		case strings.ContainsRune("\"'`", rune(token[0])) && len(token) > 1:
+			builder.WriteString(ansiGreen + token + ansiReset)
+		case token[0] >= '0' && token[0] <= '9':
+			builder.WriteString(ansiCyan + token + ansiReset)
+		case known && (lang.keywords[token] || lang.ignoreCase && lang.keywords[strings.ToLower(token)]):
+			builder.WriteString(ansiRed + token + ansiReset)
+		default:
+			builder.WriteString(token)
+		}
+	}
+	builder.WriteString(line[position:])
+
+	return builder.String()
+}
@@ -1,11 +1,12 @@
 package main
 
 import (
-	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"os"
+	"os/signal"
 
-	"github.com/sashabaranov/go-openai"
 	chatfile "github.com/vorotynsky/chatfile/lib"
 )
 
@@ -20,29 +21,37 @@ func exitWithError(msg string, err error) {
 	os.Exit(1)
 }
 
-func loadChatfileIntoContext(file *os.File, context *chatfile.Context) error {
-	reader := bufio.NewReader(file)
-	lexer := chatfile.NewLexer(reader)
-	scanner := chatfile.NewParseScanner(lexer)
+// errInterrupted is the cause of contexts canceled by Ctrl-C.
+var errInterrupted = errors.New("interrupted")
 
-	for scanner.Scan() {
-		command := scanner.Command()
-		command.Apply(context)
-	}
-	return scanner.Err()
-}
+// interruptContext returns a context canceled by the first interrupt signal,
+// so requests in progress stop cleanly. The second signal terminates the process right away.
+func interruptContext() context.Context {
+	ctx, cancel := context.WithCancelCause(context.Background())
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt)
+
+	go func() {
+		<-signals
+		cancel(errInterrupted)
+		<-signals
+		fmt.Fprintln(os.Stderr, "\nInterrupted")
+		os.Exit(130)
+	}()
 
-func createClient(credentials OpenAICredentials) *openai.Client {
-	config := openai.DefaultConfig(credentials.APIKey)
+	return ctx
+}
 
-	if credentials.BaseUrl != "" {
-		config.BaseURL = credentials.BaseUrl
-	}
+func interrupted(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), errInterrupted)
+}
 
-	if credentials.Project != "" {
-		config.OrgID = credentials.Project
-	}
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
 
-	client := openai.NewClientWithConfig(config)
-	return client
+func (c OpenAICredentials) config() chatfile.OpenAIConfig {
+	return chatfile.OpenAIConfig{APIKey: c.APIKey, BaseURL: c.BaseUrl, Project: c.Project}
 }
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	chatfile "github.com/vorotynsky/chatfile/lib"
+)
+
+const (
+	outputRaw    = "raw"
+	outputPretty = "pretty"
+	outputJSON   = "json"
+	outputEvents = "jsonl-events"
+)
+
+// output presents the response of a run as it arrives.
+type output interface {
+	start(path string, request *request) error
+	event(event chatfile.Event) error
+
+	// finish completes the output once the request is done, or has failed with err.
+	finish(response response, err error) error
+}
+
+// newOutput creates the output of a format. Pretty output falls back to raw when the file is not a terminal.
+func newOutput(format string, layout string, file *os.File) (output, error) {
+	switch format {
+	case outputRaw:
+		return &rawOutput{writer: file, layout: layout}, nil
+	case outputPretty:
+		if !isTerminal(file) {
+			return &rawOutput{writer: file, layout: layout}, nil
+		}
+		markdown := newMarkdownWriter(file)
+		return &prettyOutput{rawOutput{writer: markdown, layout: layout}, markdown, file}, nil
+	case outputJSON:
+		return &jsonOutput{writer: file}, nil
+	case outputEvents:
+		return &eventsOutput{json.NewEncoder(file)}, nil
+	}
+
+	return nil, fmt.Errorf("unknown output %q, expected %s, %s, %s or %s", format, outputRaw, outputPretty, outputJSON, outputEvents)
+}
+
+// rawOutput writes a single completion as it arrives, and several ones in the layout once they are complete.
+type rawOutput struct {
+	writer io.StringWriter
+	layout string
+	single bool
+}
+
+func (o *rawOutput) start(_ string, request *request) error {
+	o.single = max(request.Params.N, 1) == 1
+	return nil
+}
+
+func (o *rawOutput) event(event chatfile.Event) error {
+	if o.single && event.Type == chatfile.EventDelta {
+		_, err := o.writer.WriteString(event.Content)
+		return err
+	}
+	return nil
+}
+
+func (o *rawOutput) finish(response response, err error) error {
+	if err != nil || o.single {
+		return nil
+	}
+	return writeChoices(o.writer, response.choices, o.layout)
+}
+
+// prettyOutput renders Markdown with ANSI styles. Columns of several completions are written as plain text.
+type prettyOutput struct {
+	rawOutput
+	markdown *markdownWriter
+	file     *os.File
+}
+
+func (o *prettyOutput) finish(response response, err error) error {
+	if err == nil && !o.single && o.layout == layoutColumns {
+		return writeChoices(o.file, response.choices, o.layout)
+	}
+
+	err = o.rawOutput.finish(response, err)
+	if flushErr := o.markdown.Flush(); err == nil {
+		err = flushErr
+	}
+	return err
+}
+
+// silentOutput writes nothing, for runs that present the response otherwise.
+type silentOutput struct{}
+
+func (silentOutput) start(string, *request) error { return nil }
+func (silentOutput) event(chatfile.Event) error   { return nil }
+func (silentOutput) finish(response, error) error { return nil }
+
+// showReasoning wraps an event handler, writing the reasoning of the first choice to a file, dimmed on terminals.
+// A blank line separates the reasoning from the content that follows it.
+func showReasoning(file *os.File, handle func(chatfile.Event) error) func(chatfile.Event) error {
+	style, reset := "", ""
+	if isTerminal(file) {
+		style, reset = ansiDim, ansiReset
+	}
+
+	thinking := false
+	return func(event chatfile.Event) error {
+		switch {
+		case event.Type == chatfile.EventReasoning && event.Choice == 0:
+			thinking = true
+			if _, err := io.WriteString(file, style+event.Content+reset); err != nil {
+				return err
+			}
+		case event.Type != chatfile.EventUsage && event.Choice == 0 && thinking:
+			thinking = false
+			if _, err := io.WriteString(file, "\n\n"); err != nil {
+				return err
+			}
+		}
+		return handle(event)
+	}
+}
+
+// jsonOutput writes the whole response as a single json object.
+type jsonOutput struct {
+	writer io.Writer
+	path   string
+	model  chatfile.ModelName
+}
+
+type jsonChoice struct {
+	Index        int    `json:"index"`
+	Content      string `json:"content"`
+	Reasoning    string `json:"reasoning,omitempty"`
+	FinishReason string `json:"finish_reason"`
+}
+
+func (o *jsonOutput) start(path string, request *request) error {
+	o.path, o.model = path, request.Model
+	return nil
+}
+
+func (o *jsonOutput) event(chatfile.Event) error {
+	return nil
+}
+
+func (o *jsonOutput) finish(response response, err error) error {
+	if err != nil {
+		return nil
+	}
+
+	choices := make([]jsonChoice, len(response.choices))
+	for i, content := range response.choices {
+		choices[i] = jsonChoice{i, content, response.thoughts[i], response.reasons[i]}
+	}
+
+	return json.NewEncoder(o.writer).Encode(struct {
+		File    string             `json:"file"`
+		Model   chatfile.ModelName `json:"model"`
+		Choices []jsonChoice       `json:"choices"`
+		Usage   chatfile.Usage     `json:"usage"`
+	}{o.path, o.model, choices, response.usage})
+}
+
+// eventsOutput writes a json object per line for every event of the run:
+// start, delta, finish and usage, or error when the run fails.
+type eventsOutput struct {
+	encoder *json.Encoder
+}
+
+type outputEvent struct {
+	Type         string             `json:"type"`
+	File         string             `json:"file,omitempty"`
+	Model        chatfile.ModelName `json:"model,omitempty"`
+	Choice       *int               `json:"choice,omitempty"`
+	Content      string             `json:"content,omitempty"`
+	FinishReason string             `json:"finish_reason,omitempty"`
+	Usage        *chatfile.Usage    `json:"usage,omitempty"`
+	Error        string             `json:"error,omitempty"`
+}
+
+func (o *eventsOutput) start(path string, request *request) error {
+	return o.encoder.Encode(outputEvent{Type: "start", File: path, Model: request.Model})
+}
+
+func (o *eventsOutput) event(event chatfile.Event) error {
+	switch event.Type {
+	case chatfile.EventUsage:
+		return o.encoder.Encode(outputEvent{Type: string(event.Type), Usage: &event.Usage})
+	default:
+		return o.encoder.Encode(outputEvent{
+			Type:         string(event.Type),
+			Choice:       &event.Choice,
+			Content:      event.Content,
+			FinishReason: event.FinishReason,
+		})
+	}
+}
+
+func (o *eventsOutput) finish(_ response, err error) error {
+	if err == nil {
+		return nil
+	}
+	return o.encoder.Encode(outputEvent{Type: "error", Error: err.Error()})
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+)
+
+const defaultBaseUrl = "https://api.openai.com/v1"
+
+type ProxyCmd struct {
+	Dir    string `arg:"positional" placeholder:"DIR" help:"Directory of chatfiles available as models, named as by the serve command"`
+	Listen string `arg:"--listen" default:"127.0.0.1:8080" placeholder:"ADDR" help:"Address to listen on"`
+
+	LoadOptions
+	OpenAICredentials
+}
+
+// proxy forwards requests to the OpenAI API.
+//
+// A chat completion requesting a model that names a chatfile is rewritten on the way:
+// the history of the chatfile is prepended to the messages, and the model is replaced with the one of the chatfile.
+// Everything else, including streamed responses, is passed through as is.
+type proxy struct {
+	dir      string
+	options  LoadOptions
+	upstream *httputil.ReverseProxy
+}
+
+func (cmd ProxyCmd) Execute() {
+	baseUrl := cmd.BaseUrl
+	if baseUrl == "" {
+		baseUrl = defaultBaseUrl
+	}
+
+	target, err := url.Parse(baseUrl)
+	if err != nil {
+		exitWithError("Error parsing OpenAI URL:", err)
+	}
+
+	credentials := cmd.OpenAICredentials
+	p := &proxy{dir: cmd.Dir, options: cmd.LoadOptions}
+	p.upstream = &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.Out.URL.Scheme, r.Out.URL.Host = target.Scheme, target.Host
+			r.Out.URL.Path = strings.TrimSuffix(target.Path, "/") + strings.TrimPrefix(r.In.URL.Path, "/v1")
+			r.Out.URL.RawPath = ""
+			r.Out.Host = target.Host
+
+			r.Out.Header.Set("Authorization", "Bearer "+credentials.APIKey)
+			if credentials.Project != "" {
+				r.Out.Header.Set("OpenAI-Organization", credentials.Project)
+			}
+		},
+		FlushInterval: -1,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/chat/completions", p.handleCompletions)
+	mux.Handle("/v1/", p.upstream)
+
+	fmt.Fprintf(os.Stderr, "Proxying %s at http://%s\n", baseUrl, cmd.Listen)
+	exitWithError("Error serving:", http.ListenAndServe(cmd.Listen, mux))
+}
+
+// aliases maps the models provided by chatfiles to their paths.
+// Chatfiles loaded with --load-as-model take precedence over the ones found in the directory.
+func (p *proxy) aliases() (map[string]string, error) {
+	aliases := make(map[string]string)
+
+	if p.dir != "" {
+		index, err := indexChatfiles(p.dir)
+		if err != nil {
+			return nil, err
+		}
+		maps.Copy(aliases, index)
+	}
+
+	maps.Copy(aliases, p.options.ModelFiles)
+	return aliases, nil
+}
+
+func (p *proxy) handleCompletions(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, httpError{http.StatusBadRequest, err.Error()})
+		return
+	}
+
+	body, httpErr := p.rewrite(r.Context(), body)
+	if httpErr != nil {
+		writeError(w, *httpErr)
+		return
+	}
+
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.Header.Del("Content-Length")
+	p.upstream.ServeHTTP(w, r)
+}
+
+// rewrite injects the chatfile named by the model of a chat completion request.
+// Fields of the request unknown to chatfile are kept untouched, and requests for other models are returned as is.
+func (p *proxy) rewrite(ctx context.Context, body []byte) ([]byte, *httpError) {
+	var request map[string]json.RawMessage
+	if err := json.Unmarshal(body, &request); err != nil {
+		return nil, &httpError{http.StatusBadRequest, "invalid request body: " + err.Error()}
+	}
+
+	var model string
+	_ = json.Unmarshal(request["model"], &model)
+
+	aliases, err := p.aliases()
+	if err != nil {
+		return nil, &httpError{http.StatusInternalServerError, err.Error()}
+	}
+
+	path, found := aliases[model]
+	if !found {
+		return body, nil
+	}
+
+	options := p.options
+	options.ModelFiles = aliases
+
+	document, err := loadDocument(ctx, path, overrides{}, options)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error processing %s: %v\n", path, err)
+		return nil, &httpError{http.StatusUnprocessableEntity, err.Error()}
+	}
+
+	var messages []json.RawMessage
+	for _, message := range document.History.ApiMessages() {
+		encoded, _ := json.Marshal(message)
+		messages = append(messages, encoded)
+	}
+
+	var incoming []json.RawMessage
+	if err := json.Unmarshal(request["messages"], &incoming); request["messages"] != nil && err != nil {
+		return nil, &httpError{http.StatusBadRequest, "invalid messages: " + err.Error()}
+	}
+
+	set := func(field string, value any) {
+		request[field], _ = json.Marshal(value)
+	}
+	setDefault := func(field string, value any, isSet bool) {
+		if _, found := request[field]; isSet && !found {
+			set(field, value)
+		}
+	}
+
+	set("model", document.Model)
+	set("messages", append(messages, incoming...))
+
+	params := document.Params
+	setDefault("temperature", params.Temperature, params.Temperature != 0)
+	setDefault("seed", params.Seed, params.Seed != nil)
+	setDefault("max_tokens", params.MaxTokens, params.MaxTokens != 0)
+	setDefault("n", params.N, params.N != 0)
+	setDefault("reasoning_effort", params.ReasoningEffort, params.ReasoningEffort != "")
+	setDefault("max_completion_tokens", params.MaxCompletionTokens, params.MaxCompletionTokens != 0)
+
+	body, err = json.Marshal(request)
+	if err != nil {
+		return nil, &httpError{http.StatusInternalServerError, err.Error()}
+	}
+	return body, nil
+}
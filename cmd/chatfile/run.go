@@ -1,86 +1,465 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"maps"
 	"os"
+	"strings"
 
 	chatfile "github.com/vorotynsky/chatfile/lib"
 )
 
-type RunCmd struct {
-	File string `arg:"positional, required, help:open a specified file as a chatfile"`
-
+type RequestOptions struct {
 	Temperature *float32 `arg:"--temperature" placeholder:"TEMP" help:"Temperature for the model (this option may be removed)"`
 	Seed        *int     `arg:"--seed" placeholder:"SEED" help:"Random seed for reproducible model outputs (this option may be removed)"`
+	MaxTokens   *int     `arg:"--max-tokens" placeholder:"N" help:"Maximum number of tokens to generate"`
+	N           *int     `arg:"--n" placeholder:"N" help:"Number of completions to generate, overrides PARAMETER n"`
 
-	ModelFiles map[string]string `arg:"--load-as-model,separate" placeholder:"MODEL=CHATFILE" help:"Load a file as a model with the specified name. The file will be read and parsed as a chatfile. The model name can be used in subsequent commands (such as FROM) to refer to the loaded model (this option may be removed)"`
+	JudgeModel string `arg:"--judge-model" placeholder:"MODEL" help:"Model grading EXPECT judge assertions, the model of the chatfile by default"`
+
+	Truncate string `arg:"--truncate" placeholder:"POLICY" help:"History truncation policy used when the chatfile exceeds the context window, overrides TRUNCATE: oldest, keep FIRST LAST or summarize FIRST LAST [MODEL]"`
+
+	Hooks []string `arg:"--hook,separate" placeholder:"NAME" help:"Call the hook plugin chatfile-hook-NAME found on PATH before sending every request and after receiving the reply"`
 
+	LoadOptions
+	TokenOptions
 	OpenAICredentials
 }
 
+type LoadOptions struct {
+	Branch string            `arg:"--branch" placeholder:"LABEL" help:"Send the branch of the conversation started at the LABEL, instead of the one written last"`
+	Vars   map[string]string `arg:"--var,separate" placeholder:"NAME=VALUE" help:"Set a variable substituted for ${NAME} in prompts, overrides VAR"`
+	Shell  []string          `arg:"--allow-shell,separate" placeholder:"PROGRAM" help:"Let the shell function of TEMPLATE go prompts run the PROGRAM"`
+	Env    []string          `arg:"--allow-env,separate" placeholder:"NAME" help:"Let TEMPLATE go prompts read the environment variable NAME as .Env.NAME"`
+	Paths  []string          `arg:"--allow-path,separate" placeholder:"DIR" help:"Let readFile and include of TEMPLATE go prompts read files in DIR, besides the directory of the chatfile"`
+
+	Plugins bool `arg:"--plugins" help:"Handle unknown keywords with the command plugin chatfile-cmd-KEYWORD found on PATH, such as TICKET with chatfile-cmd-ticket"`
+
+	ModelFiles map[string]string `arg:"--load-as-model,separate" placeholder:"MODEL=CHATFILE" help:"Load a file as a model with the specified name. The file will be read and parsed as a chatfile. The model name can be used in subsequent commands (such as FROM) to refer to the loaded model (this option may be removed)"`
+}
+
+type RunCmd struct {
+	File          string   `arg:"positional, required" placeholder:"FILE" help:"open a specified file as a chatfile, or - to read it from stdin"`
+	Args          []string `arg:"positional" placeholder:"ARG" help:"Values of the variables declared with VAR, in order. The remaining ones are joined into a final ASK"`
+	Append        bool     `arg:"--append" help:"Append the response to the chatfile as an ANSWER, or as several tagged with CHOICE"`
+	Layout        string   `arg:"--layout" default:"sequential" placeholder:"LAYOUT" help:"How several completions are shown: sequential or columns"`
+	Output        string   `arg:"--output" default:"raw" placeholder:"FORMAT" help:"How the response is written: raw, pretty renders Markdown on terminals, json writes a single object, jsonl-events writes start, delta, finish and usage events as json lines"`
+	StdinAs       string   `arg:"--stdin-as" placeholder:"MODE" help:"Add the data piped to stdin to the conversation: ask appends it as a final ASK, attach adds it to the last ASK as a fenced block, var:NAME sets the variable NAME"`
+	Extract       string   `arg:"--extract" placeholder:"DIR" help:"Write the fenced code blocks of the response to files in DIR, named by hints such as title=main.go or by their index"`
+	ExtractOnly   bool     `arg:"--extract-only" help:"Print only the contents of the code blocks of the response"`
+	ShowReasoning bool     `arg:"--show-reasoning" help:"Stream the reasoning of reasoning models to stderr"`
+	KeepReasoning bool     `arg:"--keep-reasoning" help:"With --append, keep the reasoning as a THOUGHT before the ANSWER. Thoughts are not sent on later turns"`
+	Watch         bool     `arg:"--watch" help:"Run again whenever the chatfile or its model files change. With --append, run only when the chatfile ends with an unanswered ASK"`
+
+	RequestOptions
+
+	// written records the answers appended while watching, so they do not count as changes.
+	written *ownWrites
+}
+
+// errFailedExpectations is returned by a run whose failed expectations are already reported.
+var errFailedExpectations = errors.New("expectations failed")
+
 func (cmd RunCmd) Execute() {
-	file, err := os.Open(cmd.File)
+	if cmd.File == "-" && (cmd.Append || cmd.Watch || cmd.StdinAs != "") {
+		exitWithError("Error:", errors.New("--append, --watch and --stdin-as need the path of a chatfile"))
+	}
+	if cmd.ExtractOnly && cmd.Output != outputRaw {
+		exitWithError("Error:", fmt.Errorf("--extract-only prints only the code of the response, it cannot be combined with --output %s", cmd.Output))
+	}
+	if cmd.Append && cmd.StdinAs == "attach" {
+		exitWithError("Error:", errors.New("--stdin-as attach changes a question of the chatfile, which --append cannot save; use --stdin-as ask"))
+	}
+
+	o, err := cmd.overrides()
+	if err == nil {
+		_, err = newOutput(cmd.Output, cmd.Layout, os.Stdout)
+	}
 	if err != nil {
-		exitWithError("Error opening file:", err)
+		exitWithError("Error:", err)
 	}
-	defer func(file *os.File) {
-		_ = file.Close()
-	}(file)
 
-	history := chatfile.OpenAiHistory{}
-	context := &chatfile.Context{History: &history}
+	runner := newRunner(cmd.RequestOptions)
+	ctx := interruptContext()
 
-	err = loadChatfileIntoContext(file, context)
-	if err != nil {
-		exitWithError("Error processing file:", err)
+	if cmd.Watch {
+		cmd.watch(ctx, runner, o)
+	} else {
+		err = cmd.run(ctx, runner, &o)
+	}
+
+	switch {
+	case interrupted(ctx):
+		fmt.Fprintln(os.Stderr, "\nInterrupted")
+		os.Exit(130)
+	case errors.Is(err, errFailedExpectations):
+		os.Exit(1)
+	case err != nil:
+		exitWithError("Error", err)
 	}
+}
 
-	substituteModelFiles(cmd.ModelFiles, context)
+// overrides collects the arguments and the data piped to stdin.
+func (cmd RunCmd) overrides() (overrides, error) {
+	o := overrides{arguments: cmd.Args}
+	if cmd.StdinAs == "" {
+		return o, nil
+	}
 
-	client := createClient(cmd.OpenAICredentials)
-	parameters := chatfile.NewParameters(cmd.Seed, cmd.Temperature)
+	mode, name, _ := strings.Cut(cmd.StdinAs, ":")
+	if (mode != "ask" && mode != "attach" || name != "") && (mode != "var" || name == "") {
+		return o, fmt.Errorf("unknown --stdin-as %s, expected ask, attach or var:NAME", cmd.StdinAs)
+	}
 
-	err = chatfile.Send(client, context.CurrentModel, history, os.Stdout, parameters)
+	data, err := io.ReadAll(os.Stdin)
 	if err != nil {
-		exitWithError("Error sending request:", err)
+		return o, fmt.Errorf("reading stdin: %w", err)
+	}
+	input := strings.TrimRight(string(data), "\n")
+
+	switch mode {
+	case "ask":
+		o.messages = []chatfile.Message{{Role: chatfile.RoleUser, Content: input}}
+	case "attach":
+		o.attachment = fence(input)
+	case "var":
+		o.vars = map[string]string{name: input}
+	}
+
+	return o, nil
+}
+
+// fence wraps a text in a Markdown code block, with a fence longer than any backtick run of the text.
+func fence(text string) string {
+	longest, run := 0, 0
+	for _, r := range text {
+		if r == '`' {
+			run++
+			longest = max(longest, run)
+		} else {
+			run = 0
+		}
 	}
+
+	marker := strings.Repeat("`", max(3, longest+1))
+	return marker + "\n" + text + "\n" + marker
 }
 
-func substituteModelFiles(modelFiles map[string]string, context *chatfile.Context) {
-	processedModels := make(map[string]bool)
+func (cmd RunCmd) run(ctx context.Context, runner *runner, o *overrides) error {
+	request, err := runner.prepare(ctx, cmd.File, *o)
+	if err != nil {
+		return fmt.Errorf("processing file: %w", err)
+	}
+	request.Params.IncludeUsage = cmd.Append || cmd.Output == outputJSON || cmd.Output == outputEvents
 
-	history := context.History.(*chatfile.OpenAiHistory)
+	var prompts []chatfile.Command
+	if cmd.Append {
+		if prompts, err = continuation(request, o.questions(request)); err != nil {
+			return err
+		}
+	}
 
-	for {
-		currentModel := string(context.CurrentModel)
+	out, err := newOutput(cmd.Output, cmd.Layout, os.Stdout)
+	if cmd.ExtractOnly {
+		out = silentOutput{}
+	}
+	if err == nil {
+		err = out.start(cmd.File, request)
+	}
+	if err != nil {
+		return fmt.Errorf("writing output: %w", err)
+	}
+
+	handle := out.event
+	if cmd.ShowReasoning {
+		handle = showReasoning(os.Stderr, handle)
+	}
+
+	response, err := runner.stream(ctx, request, handle)
+	if outErr := out.finish(response, err); err == nil && outErr != nil {
+		return fmt.Errorf("writing output: %w", outErr)
+	}
 
-		modelFilePath, found := modelFiles[currentModel]
-		if !found {
-			break
+	if err != nil && cmd.Append && interrupted(ctx) {
+		return appendInterrupted(cmd.File, prompts, newAnswers(request, response, cmd.KeepReasoning))
+	}
+	if err != nil {
+		return fmt.Errorf("sending request: %w", err)
+	}
+
+	if cmd.ExtractOnly {
+		if err = writeCode(response.choices); err != nil {
+			return fmt.Errorf("writing output: %w", err)
+		}
+	}
+
+	if cmd.Extract != "" {
+		if err = extractFiles(cmd.Extract, response.choices); err != nil {
+			return fmt.Errorf("extracting code: %w", err)
+		}
+	}
+
+	if cmd.Append {
+		err = cmd.written.write(cmd.File, func() error {
+			return appendAnswers(cmd.File, prompts, newAnswers(request, response, cmd.KeepReasoning))
+		})
+		if err != nil {
+			return fmt.Errorf("appending answer: %w", err)
 		}
+		o.appended(request)
+	}
 
-		if processedModels[currentModel] {
-			exitWithError(fmt.Sprintf("Error: Circular reference detected in model '%s'", currentModel), nil)
+	if failures := runner.check(ctx, request, response.choices); len(failures) > 0 {
+		for _, failure := range failures {
+			fmt.Fprintln(os.Stderr, failure)
 		}
+		return errFailedExpectations
+	}
+
+	return nil
+}
+
+// runner holds everything shared between requests made from several chatfiles.
+type runner struct {
+	chatfile.Runner
+	options  RequestOptions
+	truncate chatfile.TruncatePolicy
+}
+
+// request is a loaded chatfile ready to be sent.
+type request struct {
+	*chatfile.Document
+	tokens int
+}
 
-		processedModels[currentModel] = true
+func newRunner(options RequestOptions) *runner {
+	r := &runner{options: options}
+	r.Provider = chatfile.NewOpenAIProvider(options.OpenAICredentials.config())
+	r.Tokenizer, r.Windows = options.TokenOptions.load()
 
-		modelFile, err := os.Open(modelFilePath)
+	if options.Truncate != "" {
+		policy, err := chatfile.ParseTruncatePolicy(options.Truncate)
 		if err != nil {
-			exitWithError("Error opening model file:", err)
+			exitWithError("Error parsing truncate policy:", err)
 		}
+		r.truncate = policy
+	}
+
+	for _, name := range options.Hooks {
+		hook, err := chatfile.LookupPlugin(chatfile.HookPluginPrefix, name)
+		if err != nil {
+			exitWithError("Error finding hook:", err)
+		}
+		r.Hooks = append(r.Hooks, hook)
+	}
+
+	return r
+}
+
+// overrides adjust a chatfile for a single request.
+type overrides struct {
+	// model replaces the one selected by FROM when not empty.
+	model chatfile.ModelName
+
+	// vars take precedence over --var and VAR.
+	vars map[string]string
+
+	// arguments are bound to the variables declared with VAR, see [chatfile.Context.Arguments].
+	// The remaining ones are joined into a question appended to the chatfile.
+	arguments []string
+
+	// attachment is added to the last question, or as a new one, after the arguments.
+	attachment string
+
+	// messages are appended after the messages of the chatfile.
+	messages []chatfile.Message
+}
+
+// questions returns the prompts the overrides added to the conversation of a request, which the chatfile lacks:
+// the arguments left after binding the variables, joined into a question, and the messages.
+// The attachment changes a question of the chatfile instead, so it is not among them.
+func (o *overrides) questions(request *request) []chatfile.Command {
+	var prompts []chatfile.Command
+	if arguments := request.Context.Arguments; len(arguments) > 0 {
+		prompts = append(prompts, &chatfile.PromptCommand{Role: chatfile.RoleUser, Message: strings.Join(arguments, " ")})
+	}
+	for _, message := range o.messages {
+		prompts = append(prompts, &chatfile.PromptCommand{Role: message.Role, Message: message.Content, Attributes: message.Attributes})
+	}
+	return prompts
+}
+
+// appended drops the questions once they are written to the chatfile, so later runs of --watch do not repeat them.
+func (o *overrides) appended(request *request) {
+	o.arguments = o.arguments[:len(o.arguments)-len(request.Context.Arguments)]
+	o.messages = nil
+}
+
+// prepare loads a chatfile, truncates its history if needed and checks that it fits the context window.
+func (r *runner) prepare(ctx context.Context, path string, o overrides) (*request, error) {
+	document, err := loadDocument(ctx, path, o, r.options.LoadOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.truncate != nil {
+		document.Context.Truncate = r.truncate
+	}
+
+	options := r.options
+	document.Params = document.Params.Override(options.Seed, options.Temperature, options.MaxTokens, options.N)
+
+	original := document.Messages()
+	dropped, tokens, err := r.Fit(ctx, document)
+	logDropped(path, original, dropped)
+
+	// Estimated counts are only a guess, so the API decides whether the request fits.
+	if _, estimated := r.Tokenizer.(chatfile.EstimateTokenizer); estimated && errors.Is(err, chatfile.ErrContextWindowExceeded) {
+		fmt.Fprintf(os.Stderr, "Warning: %s: %v (estimated, use --encoding for exact counts)\n", path, err)
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &request{document, tokens}, nil
+}
+
+// response is everything received for a request.
+type response struct {
+	choices  []string
+	thoughts []string
+	reasons  []string
+	usage    chatfile.Usage
+}
 
-		parentHistory := chatfile.OpenAiHistory{}
-		parentContext := &chatfile.Context{History: &parentHistory}
-		err = loadChatfileIntoContext(modelFile, parentContext)
-		err = errors.Join(err, modelFile.Close())
+// send streams a single completion to the writer as it arrives.
+// Several completions are collected first and then written in the layout.
+func (r *runner) send(ctx context.Context, request *request, writer io.StringWriter, layout string) (response, error) {
+	single := max(request.Params.N, 1) == 1
 
+	response, err := r.stream(ctx, request, func(event chatfile.Event) error {
+		if single && event.Type == chatfile.EventDelta {
+			_, err := writer.WriteString(event.Content)
+			return err
+		}
+		return nil
+	})
+	if err != nil || single {
+		return response, err
+	}
+
+	return response, writeChoices(writer, response.choices, layout)
+}
+
+// stream sends the request, passing every event of the reply to the handler, and collects the choices.
+// An error returned by the handler stops the request.
+// On errors the choices received so far are returned along with the error.
+func (r *runner) stream(ctx context.Context, request *request, handle func(chatfile.Event) error) (response, error) {
+	choices := make([]strings.Builder, max(request.Params.N, 1))
+	thoughts := make([]strings.Builder, len(choices))
+	reasons := make([]string, len(choices))
+	var usage chatfile.Usage
+
+	collected := func() response {
+		texts, reasoning := make([]string, len(choices)), make([]string, len(choices))
+		for i := range choices {
+			texts[i], reasoning[i] = choices[i].String(), thoughts[i].String()
+		}
+		return response{texts, reasoning, reasons, usage}
+	}
+
+	for event, err := range r.Stream(ctx, request.Document) {
 		if err != nil {
-			exitWithError(fmt.Sprintf("Error processing model file %s:", modelFilePath), err)
+			return collected(), err
+		}
+
+		switch {
+		case event.Type == chatfile.EventUsage:
+			usage = event.Usage
+		case event.Type == chatfile.EventDelta && event.Choice < len(choices):
+			choices[event.Choice].WriteString(event.Content)
+		case event.Type == chatfile.EventReasoning && event.Choice < len(choices):
+			thoughts[event.Choice].WriteString(event.Content)
+		case event.Type == chatfile.EventFinish && event.Choice < len(choices):
+			reasons[event.Choice] = event.FinishReason
+		default:
+			continue
+		}
+
+		if err = handle(event); err != nil {
+			return collected(), err
 		}
+	}
+
+	return collected(), nil
+}
+
+// check tests every choice against the expectations of the chatfile and returns the failed ones.
+func (r *runner) check(ctx context.Context, request *request, choices []string) (failures []error) {
+	judgeModel := request.Model
+	if r.options.JudgeModel != "" {
+		judgeModel = chatfile.ModelName(r.options.JudgeModel)
+	}
+	judge := r.Judge(ctx, judgeModel)
+
+	for i, reply := range choices {
+		for _, expectation := range request.Context.Expectations {
+			err := expectation.Check(reply, judge)
+			if err != nil && len(choices) > 1 {
+				err = fmt.Errorf("choice %d: %w", i+1, err)
+			}
+			if err != nil {
+				failures = append(failures, err)
+			}
+		}
+	}
+	return
+}
+
+// logDropped reports every message removed by truncation with the beginning of its content.
+func logDropped(path string, messages []chatfile.Message, dropped []int) {
+	for _, i := range dropped {
+		content, _, cut := strings.Cut(messages[i].Content, "\n")
+		if runes := []rune(content); cut || len(runes) > 60 {
+			content = string(runes[:min(len(runes), 60)]) + "..."
+		}
+		fmt.Fprintf(os.Stderr, "Truncated message #%d of %s (%s): %s\n", i+1, path, messages[i].Role, content)
+	}
+}
+
+// loadDocument reads a chatfile with the overrides, which take precedence over the options.
+// The path - reads the chatfile from stdin. Command plugins are called until ctx is done.
+func loadDocument(ctx context.Context, path string, o overrides, options LoadOptions) (*chatfile.Document, error) {
+	if options.Plugins {
+		chatfile.UsePlugins()
+	}
+
+	vars := maps.Clone(options.Vars)
+	if vars == nil {
+		vars = make(map[string]string)
+	}
+	maps.Copy(vars, o.vars)
+
+	loadOptions := chatfile.LoadOptions{
+		Branch:     options.Branch,
+		Vars:       vars,
+		Arguments:  o.arguments,
+		Attachment: o.attachment,
+		Messages:   o.messages,
+		Model:      o.model,
+		Shell:      options.Shell,
+		Env:        options.Env,
+		Paths:      options.Paths,
+		ModelFiles: options.ModelFiles,
+		Context:    ctx,
+	}
 
-		history.PrependHistory(parentHistory)
-		context.CurrentModel = parentContext.CurrentModel
+	if path == "-" {
+		return chatfile.LoadReader(os.Stdin, loadOptions)
 	}
+	return chatfile.Load(path, loadOptions)
 }
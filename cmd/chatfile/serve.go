@@ -0,0 +1,399 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+	chatfile "github.com/vorotynsky/chatfile/lib"
+)
+
+type ServeCmd struct {
+	Dir    string `arg:"positional, required" placeholder:"DIR" help:"Directory of the chatfiles to serve"`
+	Listen string `arg:"--listen" default:"127.0.0.1:8080" placeholder:"ADDR" help:"Address to listen on"`
+
+	RequestOptions
+}
+
+// server exposes the chatfiles of a directory over HTTP.
+//
+// Every chatfile is available at POST /<name>, and as a model of the OpenAI-compatible
+// POST /v1/chat/completions endpoint, where the messages of the request continue the chatfile.
+// Chatfiles are named as by [indexChatfiles].
+type server struct {
+	dir    string
+	runner *runner
+}
+
+// chatfileRequest is the body of POST /<name>. All fields are optional.
+type chatfileRequest struct {
+	Variables map[string]string `json:"variables"`
+	Ask       string            `json:"ask"`
+	Stream    bool              `json:"stream"`
+}
+
+type chatfileResponse struct {
+	Content string         `json:"content"`
+	Choices []string       `json:"choices"`
+	Usage   chatfile.Usage `json:"usage"`
+}
+
+// chatfileEvent is a server-sent event of a streamed reply of POST /<name>.
+type chatfileEvent struct {
+	Type         chatfile.EventType `json:"type"`
+	Choice       int                `json:"choice"`
+	Content      string             `json:"content,omitempty"`
+	FinishReason string             `json:"finish_reason,omitempty"`
+	Usage        *chatfile.Usage    `json:"usage,omitempty"`
+}
+
+// httpError is reported to clients in the format of the OpenAI API.
+type httpError struct {
+	status  int
+	message string
+}
+
+func (cmd ServeCmd) Execute() {
+	info, err := os.Stat(cmd.Dir)
+	if err == nil && !info.IsDir() {
+		err = fmt.Errorf("%s is not a directory", cmd.Dir)
+	}
+	if err != nil {
+		exitWithError("Error opening directory:", err)
+	}
+
+	s := &server{dir: cmd.Dir, runner: newRunner(cmd.RequestOptions)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", s.handleList)
+	mux.HandleFunc("GET /v1/models", s.handleModels)
+	mux.HandleFunc("POST /v1/chat/completions", s.handleCompletions)
+	mux.HandleFunc("POST /{name...}", s.handleChatfile)
+
+	fmt.Fprintf(os.Stderr, "Serving chatfiles of %s at http://%s\n", cmd.Dir, cmd.Listen)
+	exitWithError("Error serving:", http.ListenAndServe(cmd.Listen, mux))
+}
+
+// chatfiles indexes the directory on every request, so added and edited chatfiles are served right away.
+func (s *server) chatfiles() (map[string]string, error) {
+	return indexChatfiles(s.dir)
+}
+
+// indexChatfiles maps names of the chatfiles in a directory to their paths.
+// Names are paths relative to the directory: a.chatfile is named a, and b/chatfile is named b.
+func indexChatfiles(dir string) (map[string]string, error) {
+	index := make(map[string]string)
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		name, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case d.Name() == "chatfile":
+			name = filepath.Dir(name)
+		case filepath.Ext(name) == ".chatfile":
+			name = strings.TrimSuffix(name, ".chatfile")
+		default:
+			return nil
+		}
+
+		if name != "." {
+			index[filepath.ToSlash(name)] = path
+		}
+		return nil
+	})
+
+	return index, err
+}
+
+func (s *server) handleList(w http.ResponseWriter, _ *http.Request) {
+	index, err := s.chatfiles()
+	if err != nil {
+		writeError(w, httpError{http.StatusInternalServerError, err.Error()})
+		return
+	}
+
+	writeJSON(w, map[string][]string{"chatfiles": slices.Sorted(maps.Keys(index))})
+}
+
+func (s *server) handleModels(w http.ResponseWriter, _ *http.Request) {
+	index, err := s.chatfiles()
+	if err != nil {
+		writeError(w, httpError{http.StatusInternalServerError, err.Error()})
+		return
+	}
+
+	models := []openai.Model{}
+	for _, name := range slices.Sorted(maps.Keys(index)) {
+		models = append(models, openai.Model{ID: name, Object: "model", OwnedBy: "chatfile"})
+	}
+
+	writeJSON(w, map[string]any{"object": "list", "data": models})
+}
+
+func (s *server) handleChatfile(w http.ResponseWriter, r *http.Request) {
+	var body chatfileRequest
+	if err := decodeBody(r, &body); err != nil {
+		writeError(w, *err)
+		return
+	}
+
+	o := overrides{vars: body.Variables}
+	if body.Ask != "" {
+		o.messages = []chatfile.Message{{Role: chatfile.RoleUser, Content: body.Ask}}
+	}
+
+	request, httpErr := s.prepare(r.Context(), r.PathValue("name"), o)
+	if httpErr != nil {
+		writeError(w, *httpErr)
+		return
+	}
+	request.Params.IncludeUsage = true
+
+	if !body.Stream && !strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		response, err := s.runner.stream(r.Context(), request, func(chatfile.Event) error { return nil })
+		if err != nil {
+			writeError(w, httpError{http.StatusBadGateway, err.Error()})
+			return
+		}
+
+		writeJSON(w, chatfileResponse{response.choices[0], response.choices, response.usage})
+		return
+	}
+
+	events := newEventStream(w)
+	_, err := s.runner.stream(r.Context(), request, func(event chatfile.Event) error {
+		data := chatfileEvent{Type: event.Type, Choice: event.Choice, Content: event.Content, FinishReason: event.FinishReason}
+		if event.Type == chatfile.EventUsage {
+			data.Usage = &event.Usage
+		}
+		return events.send(data)
+	})
+	events.finish(err)
+}
+
+func (s *server) handleCompletions(w http.ResponseWriter, r *http.Request) {
+	var body openai.ChatCompletionRequest
+	if err := decodeBody(r, &body); err != nil {
+		writeError(w, *err)
+		return
+	}
+
+	o := overrides{}
+	for _, message := range body.Messages {
+		role, found := map[string]chatfile.Role{
+			openai.ChatMessageRoleSystem:    chatfile.RoleSystem,
+			openai.ChatMessageRoleDeveloper: chatfile.RoleSystem,
+			openai.ChatMessageRoleUser:      chatfile.RoleUser,
+			openai.ChatMessageRoleAssistant: chatfile.RoleAssistant,
+		}[message.Role]
+		if !found {
+			writeError(w, httpError{http.StatusBadRequest, "unsupported message role " + message.Role})
+			return
+		}
+
+		content := message.Content
+		for _, part := range message.MultiContent {
+			content += part.Text
+		}
+		o.messages = append(o.messages, chatfile.Message{Role: role, Content: content})
+	}
+
+	request, httpErr := s.prepare(r.Context(), body.Model, o)
+	if httpErr != nil {
+		writeError(w, *httpErr)
+		return
+	}
+	request.Params = overrideFromAPI(request.Params, body)
+	request.Params.IncludeUsage = !body.Stream || body.StreamOptions != nil && body.StreamOptions.IncludeUsage
+
+	id := fmt.Sprintf("chatcmpl-%d", time.Now().UnixNano())
+	created := time.Now().Unix()
+
+	if !body.Stream {
+		response, err := s.runner.stream(r.Context(), request, func(chatfile.Event) error { return nil })
+		if err != nil {
+			writeError(w, httpError{http.StatusBadGateway, err.Error()})
+			return
+		}
+
+		completion := openai.ChatCompletionResponse{
+			ID: id, Object: "chat.completion", Created: created, Model: body.Model,
+			Usage: openai.Usage{
+				PromptTokens:     response.usage.PromptTokens,
+				CompletionTokens: response.usage.CompletionTokens,
+				TotalTokens:      response.usage.TotalTokens,
+			},
+		}
+		for i, content := range response.choices {
+			completion.Choices = append(completion.Choices, openai.ChatCompletionChoice{
+				Index:        i,
+				Message:      openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: content, ReasoningContent: response.thoughts[i]},
+				FinishReason: openai.FinishReason(response.reasons[i]),
+			})
+		}
+
+		writeJSON(w, completion)
+		return
+	}
+
+	chunk := func(choices []openai.ChatCompletionStreamChoice, usage *openai.Usage) openai.ChatCompletionStreamResponse {
+		return openai.ChatCompletionStreamResponse{
+			ID: id, Object: "chat.completion.chunk", Created: created, Model: body.Model,
+			Choices: choices, Usage: usage,
+		}
+	}
+	events := newEventStream(w)
+	response, err := s.runner.stream(r.Context(), request, func(event chatfile.Event) error {
+		choice := openai.ChatCompletionStreamChoice{Index: event.Choice}
+		switch event.Type {
+		case chatfile.EventDelta:
+			choice.Delta = openai.ChatCompletionStreamChoiceDelta{Role: openai.ChatMessageRoleAssistant, Content: event.Content}
+		case chatfile.EventReasoning:
+			choice.Delta = openai.ChatCompletionStreamChoiceDelta{Role: openai.ChatMessageRoleAssistant, ReasoningContent: event.Content}
+		case chatfile.EventFinish:
+			choice.FinishReason = openai.FinishReason(event.FinishReason)
+		default:
+			return nil
+		}
+		return events.send(chunk([]openai.ChatCompletionStreamChoice{choice}, nil))
+	})
+
+	if err == nil && request.Params.IncludeUsage {
+		usage := response.usage
+		err = events.send(chunk([]openai.ChatCompletionStreamChoice{}, &openai.Usage{
+			PromptTokens: usage.PromptTokens, CompletionTokens: usage.CompletionTokens, TotalTokens: usage.TotalTokens,
+		}))
+	}
+	events.finish(err)
+}
+
+// prepare finds a chatfile by its name and loads it with the overrides.
+func (s *server) prepare(ctx context.Context, name string, o overrides) (*request, *httpError) {
+	index, err := s.chatfiles()
+	if err != nil {
+		return nil, &httpError{http.StatusInternalServerError, err.Error()}
+	}
+
+	path, found := index[name]
+	if !found {
+		return nil, &httpError{http.StatusNotFound, fmt.Sprintf("chatfile %s not found", name)}
+	}
+
+	request, err := s.runner.prepare(ctx, path, o)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error processing %s: %v\n", path, err)
+		return nil, &httpError{http.StatusUnprocessableEntity, err.Error()}
+	}
+
+	return request, nil
+}
+
+// overrideFromAPI replaces the parameters of the chatfile with the ones set in an API request.
+func overrideFromAPI(params chatfile.RequestParams, body openai.ChatCompletionRequest) chatfile.RequestParams {
+	var temperature *float32
+	if body.Temperature != 0 {
+		temperature = &body.Temperature
+	}
+
+	var maxTokens *int
+	for _, tokens := range []int{body.MaxTokens, body.MaxCompletionTokens} {
+		if tokens != 0 {
+			maxTokens = &tokens
+		}
+	}
+
+	var n *int
+	if body.N != 0 {
+		n = &body.N
+	}
+
+	params = params.Override(body.Seed, temperature, maxTokens, n)
+	if body.ReasoningEffort != "" {
+		params.ReasoningEffort = body.ReasoningEffort
+	}
+	return params
+}
+
+// decodeBody reads a json request body. An empty body leaves the value as it is.
+func decodeBody(r *http.Request, value any) *httpError {
+	err := json.NewDecoder(r.Body).Decode(value)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return &httpError{http.StatusBadRequest, "invalid request body: " + err.Error()}
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(value)
+}
+
+func writeError(w http.ResponseWriter, err httpError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(err.status)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"error": map[string]string{"message": err.message, "type": http.StatusText(err.status)},
+	})
+}
+
+// eventStream writes server-sent events, flushing each of them to the client.
+type eventStream struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+func newEventStream(w http.ResponseWriter) *eventStream {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+	return &eventStream{w, flusher}
+}
+
+func (e *eventStream) send(value any) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return e.write("data: " + string(data) + "\n\n")
+}
+
+// finish reports an error that happened after the stream has started, and terminates the stream.
+func (e *eventStream) finish(err error) {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error sending request:", err)
+
+		data, _ := json.Marshal(map[string]any{"error": map[string]string{"message": err.Error()}})
+		_ = e.write("event: error\ndata: " + string(data) + "\n\n")
+	}
+	_ = e.write("data: [DONE]\n\n")
+}
+
+func (e *eventStream) write(event string) error {
+	if _, err := io.WriteString(e.w, event); err != nil {
+		return err
+	}
+	if e.flusher != nil {
+		e.flusher.Flush()
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type TestCmd struct {
+	Files []string `arg:"positional, required" placeholder:"PATTERN" help:"chatfiles, glob patterns or directories to search for chatfiles"`
+
+	Runs        int     `arg:"-r,--runs" default:"1" placeholder:"N" help:"Number of times every chatfile is run"`
+	Jobs        int     `arg:"-j,--jobs" default:"4" placeholder:"N" help:"Number of runs made concurrently"`
+	MinPassRate float64 `arg:"--min-pass-rate" default:"1" placeholder:"RATE" help:"Lowest pass rate of a chatfile, from 0 to 1, that is not reported as a failure"`
+	JUnit       string  `arg:"--junit" placeholder:"FILE" help:"Write a JUnit XML report to the file"`
+
+	RequestOptions
+}
+
+// testRun is the outcome of a single run of a chatfile.
+type testRun struct {
+	failures []error
+	err      error
+	duration time.Duration
+}
+
+func (r testRun) passed() bool {
+	return r.err == nil && len(r.failures) == 0
+}
+
+func (cmd TestCmd) Execute() {
+	paths, err := expandChatfiles(cmd.Files)
+	if err != nil {
+		exitWithError("Error searching chatfiles:", err)
+	}
+
+	runner := newRunner(cmd.RequestOptions)
+	runs := max(cmd.Runs, 1)
+
+	results := make([][]testRun, len(paths))
+	for i := range results {
+		results[i] = make([]testRun, runs)
+	}
+
+	semaphore := make(chan struct{}, max(cmd.Jobs, 1))
+	var wg sync.WaitGroup
+	for i, path := range paths {
+		for run := range runs {
+			wg.Add(1)
+			semaphore <- struct{}{}
+			go func() {
+				defer wg.Done()
+				results[i][run] = cmd.run(runner, path)
+				<-semaphore
+			}()
+		}
+	}
+	wg.Wait()
+
+	failed := false
+	for i, path := range paths {
+		passed := 0
+		for _, run := range results[i] {
+			if run.passed() {
+				passed++
+			}
+		}
+
+		rate := float64(passed) / float64(runs)
+		state := "PASS"
+		if rate < cmd.MinPassRate {
+			state = "FAIL"
+			failed = true
+		}
+
+		fmt.Printf("%s %s: %d/%d passed (%.0f%%)\n", state, path, passed, runs, rate*100)
+		for n, run := range results[i] {
+			for _, err := range append(run.failures, run.err) {
+				if err != nil {
+					fmt.Printf("    run %d: %v\n", n+1, err)
+				}
+			}
+		}
+	}
+
+	if cmd.JUnit != "" {
+		if err := writeJUnit(cmd.JUnit, paths, results); err != nil {
+			exitWithError("Error writing JUnit report:", err)
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func (cmd TestCmd) run(runner *runner, path string) testRun {
+	start := time.Now()
+
+	request, err := runner.prepare(context.Background(), path, overrides{})
+	if err != nil {
+		return testRun{err: err, duration: time.Since(start)}
+	}
+
+	var output strings.Builder
+	response, err := runner.send(context.Background(), request, &output, layoutSequential)
+	if err != nil {
+		return testRun{err: err, duration: time.Since(start)}
+	}
+
+	failures := runner.check(context.Background(), request, response.choices)
+	return testRun{failures: failures, duration: time.Since(start)}
+}
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Errors   int             `xml:"errors,attr"`
+	Time     float64         `xml:"time,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      float64       `xml:"time,attr"`
+	Failure   *junitProblem `xml:"failure,omitempty"`
+	Error     *junitProblem `xml:"error,omitempty"`
+}
+
+type junitProblem struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// writeJUnit reports every chatfile as a test suite with a test case per run.
+func writeJUnit(path string, paths []string, results [][]testRun) error {
+	report := junitTestSuites{}
+
+	for i, chatfilePath := range paths {
+		suite := junitTestSuite{Name: chatfilePath, Tests: len(results[i])}
+
+		for n, run := range results[i] {
+			testCase := junitTestCase{
+				Name:      fmt.Sprintf("run %d", n+1),
+				ClassName: chatfilePath,
+				Time:      run.duration.Seconds(),
+			}
+
+			switch {
+			case run.err != nil:
+				suite.Errors++
+				testCase.Error = &junitProblem{run.err.Error(), run.err.Error()}
+			case len(run.failures) > 0:
+				suite.Failures++
+				err := errors.Join(run.failures...)
+				testCase.Failure = &junitProblem{run.failures[0].Error(), err.Error()}
+			}
+
+			suite.Time += testCase.Time
+			suite.Cases = append(suite.Cases, testCase)
+		}
+
+		report.Suites = append(report.Suites, suite)
+	}
+
+	data, err := xml.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, append([]byte(xml.Header), append(data, '\n')...), 0666)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"text/tabwriter"
+
+	chatfile "github.com/vorotynsky/chatfile/lib"
+)
+
+type TokenOptions struct {
+	Encoding       string `arg:"env:CHATFILE_ENCODING,--encoding" placeholder:"FILE" help:"BPE rank file in the tiktoken format (e.g. cl100k_base.tiktoken), or the name of a bundled encoding. Defaults to the bundled o200k_base or cl100k_base, and token counts are estimated when neither is bundled"`
+	ContextWindows string `arg:"--context-windows" placeholder:"FILE" help:"Table of model name prefixes and context window sizes extending the built-in one"`
+}
+
+type TokensCmd struct {
+	File string `arg:"positional, required, help:open a specified file as a chatfile"`
+
+	MaxTokens *int `arg:"--max-tokens" placeholder:"N" help:"Number of tokens reserved for the completion"`
+
+	LoadOptions
+	TokenOptions
+}
+
+func (cmd TokensCmd) Execute() {
+	document, err := loadDocument(context.Background(), cmd.File, overrides{}, cmd.LoadOptions)
+	if err != nil {
+		exitWithError("Error processing file:", err)
+	}
+
+	tokenizer, windows := cmd.TokenOptions.load()
+	messages := document.Messages()
+	counts, total := chatfile.CountMessages(tokenizer, messages)
+
+	out := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for i, message := range messages {
+		_, _ = fmt.Fprintf(out, "#%d\t%s\t%d\t\n", i+1, message.Role, counts[i])
+	}
+	_, _ = fmt.Fprintf(out, "total\t\t%d\t\n", total)
+	_ = out.Flush()
+
+	if size, found := windows.Lookup(document.Model); found {
+		fmt.Printf("context window of %s: %d\n", document.Model, size)
+	}
+
+	if _, ok := tokenizer.(chatfile.EstimateTokenizer); ok {
+		fmt.Println("counts are estimated, use --encoding for exact numbers")
+	}
+
+	params := document.Params.Override(nil, nil, cmd.MaxTokens, nil)
+	if err := windows.CheckContextWindow(document.Model, total, params.MaxTokens); err != nil {
+		fmt.Fprintln(os.Stderr, "Warning:", err)
+	}
+}
+
+func (opts TokenOptions) load() (chatfile.Tokenizer, chatfile.ContextWindows) {
+	tokenizer, err := chatfile.DefaultTokenizer()
+	if err != nil {
+		exitWithError("Error loading bundled encoding:", err)
+	}
+
+	if opts.Encoding != "" {
+		tokenizer, err = loadEncoding(opts.Encoding)
+		if err != nil {
+			exitWithError("Error loading encoding file:", err)
+		}
+	}
+
+	windows := chatfile.DefaultContextWindows()
+
+	if opts.ContextWindows != "" {
+		file, err := os.Open(opts.ContextWindows)
+		if err != nil {
+			exitWithError("Error opening context window table:", err)
+		}
+
+		err = windows.Load(file)
+		_ = file.Close()
+		if err != nil {
+			exitWithError("Error loading context window table:", err)
+		}
+	}
+
+	return tokenizer, windows
+}
+
+// loadEncoding reads a tiktoken rank file, or a bundled encoding by its name when there is no such file.
+func loadEncoding(path string) (chatfile.Tokenizer, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		if bpe, bundledErr := chatfile.BundledBPE(path); bundledErr == nil {
+			return bpe, nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	return chatfile.LoadBPE(file)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	chatfile "github.com/vorotynsky/chatfile/lib"
+)
+
+const (
+	pollInterval = 500 * time.Millisecond
+	settleDelay  = 100 * time.Millisecond
+)
+
+// watch runs the chatfile again whenever the files it is loaded from change,
+// canceling the run in progress. Answers appended by the run itself are not changes,
+// so the expectations are still checked after appending.
+// It returns once ctx is done.
+func (cmd RunCmd) watch(ctx context.Context, runner *runner, o overrides) {
+	cmd.written = &ownWrites{stamps: make(map[string]fileStamp)}
+
+	paths := []string{cmd.File}
+	for _, path := range cmd.ModelFiles {
+		paths = append(paths, path)
+	}
+	slices.Sort(paths[1:])
+
+	changes := watchFiles(ctx, paths)
+
+	for {
+		runCtx, cancel := context.WithCancel(ctx)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			cmd.watchRun(runCtx, runner, &o)
+		}()
+
+	wait:
+		for {
+			select {
+			case path := <-changes:
+				if !cmd.written.own(path) {
+					break wait
+				}
+			case <-ctx.Done():
+				break wait
+			}
+		}
+
+		cancel()
+		<-done
+
+		if ctx.Err() != nil {
+			return
+		}
+		settle(changes)
+	}
+}
+
+func (cmd RunCmd) watchRun(ctx context.Context, runner *runner, o *overrides) {
+	if cmd.Append {
+		unanswered, err := cmd.unanswered(ctx, *o)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error processing file:", err)
+			return
+		}
+		if !unanswered {
+			fmt.Fprintf(os.Stderr, "\nWaiting for a new ASK in %s...\n", cmd.File)
+			return
+		}
+	}
+
+	if isTerminal(os.Stdout) {
+		fmt.Print("\033[H\033[2J")
+	}
+
+	err := cmd.run(ctx, runner, o)
+	switch {
+	case errors.Is(err, context.Canceled), interrupted(ctx):
+		return
+	case err != nil && !errors.Is(err, errFailedExpectations):
+		fmt.Fprintln(os.Stderr, "Error", err)
+	}
+
+	fmt.Fprintf(os.Stderr, "\nWatching %s for changes...\n", cmd.File)
+}
+
+// unanswered reports whether the conversation of the chatfile ends with a question,
+// including the ones of the overrides that are not appended yet.
+func (cmd RunCmd) unanswered(ctx context.Context, o overrides) (bool, error) {
+	document, err := loadDocument(ctx, cmd.File, o, cmd.LoadOptions)
+	if err != nil {
+		return false, err
+	}
+
+	messages := document.Messages()
+	return len(messages) > 0 && messages[len(messages)-1].Role == chatfile.RoleUser, nil
+}
+
+// fileStamp tells whether a file has changed since it was stamped.
+type fileStamp struct {
+	size     int64
+	modified int64
+}
+
+func stamp(path string) fileStamp {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}
+	}
+	return fileStamp{info.Size(), info.ModTime().UnixNano()}
+}
+
+// ownWrites remembers the files as they were after the last write of the watch itself.
+type ownWrites struct {
+	mu     sync.Mutex
+	stamps map[string]fileStamp
+}
+
+// write runs a write to the file and stamps it. The lock is held meanwhile,
+// so its change cannot be reported before the stamp is taken.
+// A nil ownWrites just runs the write.
+func (w *ownWrites) write(path string, write func() error) error {
+	if w == nil {
+		return write()
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	err := write()
+	w.stamps[path] = stamp(path)
+	return err
+}
+
+// own reports whether the file is unchanged since the last write of the watch.
+func (w *ownWrites) own(path string) bool {
+	if w == nil {
+		return false
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	written, found := w.stamps[path]
+	return found && written == stamp(path)
+}
+
+// settle waits until the files stop changing, as editors often save a file in several steps.
+func settle(changes <-chan string) {
+	for {
+		select {
+		case <-changes:
+		case <-time.After(settleDelay):
+			return
+		}
+	}
+}
+
+// pollFiles reports changed files by checking their modification times periodically.
+func pollFiles(ctx context.Context, paths []string, changes chan<- string) {
+	modified := func(path string) time.Time {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}
+		}
+		return info.ModTime()
+	}
+
+	times := make(map[string]time.Time)
+	for _, path := range paths {
+		times[path] = modified(path)
+	}
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for _, path := range paths {
+			if t := modified(path); !t.Equal(times[path]) {
+				times[path] = t
+				select {
+				case changes <- path:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// watchFiles reports changed files on the returned channel until ctx is done.
+// It relies on inotify and falls back to polling when inotify is not available.
+func watchFiles(ctx context.Context, paths []string) <-chan string {
+	changes := make(chan string)
+
+	go func() {
+		if err := inotifyFiles(ctx, paths, changes); err != nil {
+			fmt.Fprintln(os.Stderr, "Watching files with inotify failed, polling instead:", err)
+			pollFiles(ctx, paths, changes)
+		}
+	}()
+
+	return changes
+}
+
+// inotifyFiles watches the directories of the files rather than the files themselves,
+// because editors often save a file by replacing it.
+func inotifyFiles(ctx context.Context, paths []string, changes chan<- string) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return os.NewSyscallError("inotify_init1", err)
+	}
+
+	events := os.NewFile(uintptr(fd), "inotify")
+	defer func(events *os.File) {
+		_ = events.Close()
+	}(events)
+
+	go func() {
+		<-ctx.Done()
+		_ = events.Close()
+	}()
+
+	watched := make(map[string]string)
+	dirs := make(map[int32]string)
+	for _, path := range paths {
+		absolute, err := filepath.Abs(path)
+		if err != nil {
+			return err
+		}
+		watched[absolute] = path
+
+		dir := filepath.Dir(absolute)
+		wd, err := syscall.InotifyAddWatch(fd, dir, syscall.IN_CLOSE_WRITE|syscall.IN_MOVED_TO|syscall.IN_CREATE)
+		if err != nil {
+			return os.NewSyscallError("inotify_add_watch", err)
+		}
+		dirs[int32(wd)] = dir
+	}
+
+	buffer := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := events.Read(buffer)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buffer[offset]))
+			name := buffer[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+int(event.Len)]
+			offset += syscall.SizeofInotifyEvent + int(event.Len)
+
+			path, found := watched[filepath.Join(dirs[event.Wd], strings.TrimRight(string(name), "\x00"))]
+			if !found {
+				continue
+			}
+
+			select {
+			case changes <- path:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+import "context"
+
+// watchFiles reports changed files on the returned channel until ctx is done.
+func watchFiles(ctx context.Context, paths []string) <-chan string {
+	changes := make(chan string)
+	go pollFiles(ctx, paths, changes)
+	return changes
+}
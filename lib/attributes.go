@@ -0,0 +1,66 @@
+package chatfile
+
+import (
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Attributes is the metadata of a command, written in brackets after its keyword:
+//
+//	ANSWER [model=gpt-4.1 time=2026-10-16T10:00Z tokens=312] |
+//	ASK [cache name="Jane Doe"] |
+//
+// An attribute without a value, such as cache, is a flag and maps to an empty string.
+// Quoted values may escape quotes, backslashes and line breaks as \", \\, \n and \r.
+type Attributes map[string]string
+
+const AttributeName = "name"
+
+var (
+	attributeList = regexp.MustCompile(`^\[\s*(?:[A-Za-z_][\w.-]*(?:=(?:"(?:[^"\\\n]|\\.)*"|[^\s"\]]*))?\s*)*\]`)
+	attribute     = regexp.MustCompile(`([A-Za-z_][\w.-]*)(?:=("(?:[^"\\]|\\.)*"|[^\s"\]]*))?`)
+
+	attributeEscaper   = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`)
+	attributeUnescaper = strings.NewReplacer(`\\`, `\`, `\"`, `"`, `\n`, "\n", `\r`, "\r")
+)
+
+// ParseAttributes reads the attributes of a list, with or without the enclosing brackets.
+// Later attributes replace earlier ones with the same key.
+func ParseAttributes(text string) Attributes {
+	text = strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(text), "["), "]")
+
+	attributes := make(Attributes)
+	for _, match := range attribute.FindAllStringSubmatch(text, -1) {
+		value := match[2]
+		if len(value) >= 2 && value[0] == '"' {
+			value = attributeUnescaper.Replace(value[1 : len(value)-1])
+		}
+		attributes[match[1]] = value
+	}
+	return attributes
+}
+
+// String formats the attributes as a bracketed list sorted by key, quoting values when needed.
+func (a Attributes) String() string {
+	keys := make([]string, 0, len(a))
+	for key := range a {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	items := make([]string, len(keys))
+	for i, key := range keys {
+		value := a[key]
+		switch {
+		case value == "":
+			items[i] = key
+		case strings.ContainsAny(value, " \t]\"\n\r"):
+			items[i] = key + `="` + attributeEscaper.Replace(value) + `"`
+		default:
+			items[i] = key + "=" + value
+		}
+	}
+
+	return "[" + strings.Join(items, " ") + "]"
+}
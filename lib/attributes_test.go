@@ -0,0 +1,84 @@
+package chatfile
+
+import (
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseAttributes(t *testing.T) {
+	cases := map[string]Attributes{
+		"[cache]":                         {"cache": ""},
+		`model=gpt-4.1 name="Jane Doe"`:   {"model": "gpt-4.1", "name": "Jane Doe"},
+		"[tokens=1 tokens=2]":             {"tokens": "2"},
+		"[time=2026-10-16T10:00Z empty=]": {"time": "2026-10-16T10:00Z", "empty": ""},
+		"[]":                              {},
+	}
+
+	for text, expected := range cases {
+		if actual := ParseAttributes(text); !maps.Equal(actual, expected) {
+			t.Errorf("ParseAttributes(%q) = %v, expected %v", text, actual, expected)
+		}
+	}
+}
+
+func TestFormatAttributes(t *testing.T) {
+	attributes := Attributes{"tokens": "312", "name": "Jane Doe", "interrupted": "", "model": "gpt-4.1"}
+
+	expected := `[interrupted model=gpt-4.1 name="Jane Doe" tokens=312]`
+	if actual := attributes.String(); actual != expected {
+		t.Errorf("String() = %s, expected %s", actual, expected)
+	}
+
+	if parsed := ParseAttributes(attributes.String()); !maps.Equal(parsed, attributes) {
+		t.Errorf("ParseAttributes(String()) = %v, expected %v", parsed, attributes)
+	}
+
+	escaped := Attributes{"model": `say "hi"`, "finish": "line\nbreak\r", "path": `C:\dir\`, "quote": `"`}
+	document, err := LoadReader(strings.NewReader("ANSWER "+escaped.String()+" Hi\n"), LoadOptions{})
+	if err != nil {
+		t.Fatalf("%v: %v", escaped, err)
+	}
+	if parsed := document.Messages()[0].Attributes; !maps.Equal(parsed, escaped) {
+		t.Errorf("%s is read as %v", escaped, parsed)
+	}
+}
+
+// Chatfiles written before attributes existed may start prompts with a bracketed list.
+// It is read as attributes only when the rest of the line holds the prompt.
+func TestAttributeListsInPrompts(t *testing.T) {
+	source := "ASK [TODO] fix this\nASK [important]\nASK |\n    [TODO] fix this\nASK [1, 2, 3] Sum them\n"
+	document, err := LoadReader(strings.NewReader(source), LoadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messages := document.Messages()
+	if expected := []string{"fix this", "[important]", "[TODO] fix this", "[1, 2, 3] Sum them"}; !slices.Equal(contents(messages), expected) {
+		t.Errorf("messages %q, expected %q", contents(messages), expected)
+	}
+	if _, found := messages[0].Attributes["TODO"]; !found {
+		t.Errorf("attributes %v, expected TODO", messages[0].Attributes)
+	}
+}
+
+func TestAttributedMessages(t *testing.T) {
+	history := &OpenAiHistory{}
+	ctx := &Context{History: history}
+
+	(&PromptCommand{RoleUser, "Hi", Attributes{AttributeName: "jane"}}).Apply(ctx)
+	(&LabelCommand{"start"}).Apply(ctx)
+	(&PromptCommand{RoleAssistant, "Hello", Attributes{"model": "gpt-4.1"}}).Apply(ctx)
+	if err := ctx.Flatten(""); err != nil {
+		t.Fatal(err)
+	}
+
+	messages := history.ApiMessages()
+	if len(messages) != 2 || messages[0].Name != "jane" || messages[1].Name != "" {
+		t.Fatalf("unexpected messages %+v", messages)
+	}
+	if model := history.Messages()[1].Attributes["model"]; model != "gpt-4.1" {
+		t.Errorf("attributes of a branch are lost, model is %q", model)
+	}
+}
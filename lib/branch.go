@@ -0,0 +1,139 @@
+package chatfile
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+)
+
+var (
+	ErrUnknownLabel   = errors.New("context: unknown label")
+	ErrDuplicateLabel = errors.New("context: duplicate label")
+	ErrUnlabeledTip   = errors.New("context: no label at the end of the branch")
+)
+
+// HistoryTree keeps alternative continuations of a conversation.
+//
+// Messages are nodes pointing to their parent. LABEL names the current node,
+// and CONTINUE FROM moves back to a named node, so the following messages start a new branch.
+// A label follows the messages appended right after it, until the conversation continues elsewhere,
+// so selecting a label selects the whole branch started at it.
+type HistoryTree struct {
+	nodes  []historyNode
+	cursor int
+	labels map[string]int
+	tips   map[string]int
+	err    error
+}
+
+type historyNode struct {
+	parent  int
+	message Message
+}
+
+const treeRoot = -1
+
+func NewHistoryTree() *HistoryTree {
+	return &HistoryTree{
+		cursor: treeRoot,
+		labels: make(map[string]int),
+		tips:   make(map[string]int),
+	}
+}
+
+func (t *HistoryTree) Append(role Role, message string) {
+	t.AppendMessage(Message{Role: role, Content: message})
+}
+
+func (t *HistoryTree) AppendMessage(message Message) {
+	t.nodes = append(t.nodes, historyNode{t.cursor, message})
+	node := len(t.nodes) - 1
+
+	for label, tip := range t.tips {
+		if tip == t.cursor {
+			t.tips[label] = node
+		}
+	}
+
+	t.cursor = node
+}
+
+// Label names the current position in the conversation.
+func (t *HistoryTree) Label(name string) {
+	if _, found := t.labels[name]; found {
+		t.setErr(fmt.Errorf("%w %s", ErrDuplicateLabel, name))
+		return
+	}
+
+	t.labels[name] = t.cursor
+	t.tips[name] = t.cursor
+}
+
+// ContinueFrom moves back to a labeled position, starting a new branch there.
+func (t *HistoryTree) ContinueFrom(name string) {
+	node, found := t.labels[name]
+	if !found {
+		t.setErr(fmt.Errorf("%w %s", ErrUnknownLabel, name))
+		return
+	}
+
+	t.cursor = node
+}
+
+// Path returns the messages from the beginning of the conversation to the tip of the labeled branch.
+// An empty label selects the branch written last.
+func (t *HistoryTree) Path(label string) ([]Message, error) {
+	if t.err != nil {
+		return nil, t.err
+	}
+
+	node := t.cursor
+	if label != "" {
+		tip, found := t.tips[label]
+		if !found {
+			return nil, fmt.Errorf("%w %s", ErrUnknownLabel, label)
+		}
+		node = tip
+	}
+
+	var path []Message
+	for ; node != treeRoot; node = t.nodes[node].parent {
+		path = append(path, t.nodes[node].message)
+	}
+
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+	return path, nil
+}
+
+// Continuation returns the label to continue from, so that messages appended after all commands extend the labeled branch.
+// It is empty when the branch is the one written last. A branch that goes on after its label can only be continued
+// from another label at its end, and [ErrUnlabeledTip] is returned when there is none.
+func (t *HistoryTree) Continuation(label string) (string, error) {
+	tip, found := t.tips[label]
+	if !found {
+		return "", fmt.Errorf("%w %s", ErrUnknownLabel, label)
+	}
+
+	if tip == t.cursor {
+		return "", nil
+	}
+	if t.labels[label] == tip {
+		return label, nil
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(t.labels)) {
+		if t.labels[name] == tip {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("%w %s", ErrUnlabeledTip, label)
+}
+
+func (t *HistoryTree) setErr(err error) {
+	if t.err == nil {
+		t.err = err
+	}
+}
@@ -0,0 +1,81 @@
+package chatfile
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestHistoryTree(t *testing.T) {
+	tree := NewHistoryTree()
+
+	tree.Append(RoleUser, "prefix")
+	tree.Label("start")
+	tree.Append(RoleUser, "a")
+	tree.Label("a")
+	tree.Append(RoleAssistant, "answer a")
+	tree.ContinueFrom("start")
+	tree.Label("b")
+	tree.Append(RoleUser, "b")
+	tree.ContinueFrom("a")
+	tree.Append(RoleAssistant, "another answer a")
+
+	cases := map[string][]string{
+		"":      {"prefix", "a", "another answer a"},
+		"start": {"prefix", "a", "answer a"},
+		"a":     {"prefix", "a", "answer a"},
+		"b":     {"prefix", "b"},
+	}
+
+	for label, expected := range cases {
+		path, err := tree.Path(label)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := contents(path); !slices.Equal(actual, expected) {
+			t.Errorf("Path(%q) = %v, expected %v", label, actual, expected)
+		}
+	}
+
+	if _, err := tree.Path("c"); !errors.Is(err, ErrUnknownLabel) {
+		t.Errorf("expected %v, got %v", ErrUnknownLabel, err)
+	}
+}
+
+func TestHistoryTreeContinuation(t *testing.T) {
+	tree := NewHistoryTree()
+
+	tree.Append(RoleUser, "question")
+	tree.Label("start")
+	tree.Append(RoleAssistant, "first answer")
+	tree.Label("first")
+	tree.ContinueFrom("start")
+	tree.Label("second")
+	tree.Append(RoleAssistant, "second answer")
+	tree.Label("last")
+
+	cases := map[string]string{"start": "first", "first": "first", "second": "", "last": ""}
+	for label, expected := range cases {
+		if actual, err := tree.Continuation(label); err != nil || actual != expected {
+			t.Errorf("Continuation(%q) = %q, %v, expected %q", label, actual, err, expected)
+		}
+	}
+
+	tree.ContinueFrom("first")
+	tree.Append(RoleUser, "follow-up")
+	tree.ContinueFrom("start")
+
+	if _, err := tree.Continuation("first"); !errors.Is(err, ErrUnlabeledTip) {
+		t.Errorf("expected %v, got %v", ErrUnlabeledTip, err)
+	}
+}
+
+func TestHistoryTreeDuplicateLabel(t *testing.T) {
+	tree := NewHistoryTree()
+	tree.Label("start")
+	tree.Label("start")
+
+	if _, err := tree.Path(""); !errors.Is(err, ErrDuplicateLabel) {
+		t.Errorf("expected %v, got %v", ErrDuplicateLabel, err)
+	}
+}
@@ -0,0 +1,128 @@
+package chatfile
+
+import (
+	"strings"
+)
+
+// CodeBlock is a fenced code block of a Markdown text.
+type CodeBlock struct {
+	Language string
+
+	// Attributes are the key=value pairs of the info string following the language, such as title=main.go.
+	// A bare word with a dot, as in ```go main.go, is taken as the title.
+	Attributes map[string]string
+
+	Content string
+}
+
+// fileNameAttributes are the attributes naming the file of a code block, by priority.
+var fileNameAttributes = []string{"title", "file", "filename", "name", "path"}
+
+// FileName returns the file name suggested by the info string, or an empty string.
+func (b CodeBlock) FileName() string {
+	for _, attribute := range fileNameAttributes {
+		if name := b.Attributes[attribute]; name != "" {
+			return name
+		}
+	}
+	return ""
+}
+
+// ExtractCodeBlocks returns the fenced code blocks of a Markdown text in order.
+// A block left open at the end of the text is included, as replies may be cut off.
+func ExtractCodeBlocks(text string) []CodeBlock {
+	var blocks []CodeBlock
+	var content []string
+	var fence string
+	var block CodeBlock
+
+	for _, line := range strings.Split(text, "\n") {
+		trimmed := strings.TrimSpace(line)
+
+		if fence == "" {
+			marker := fenceMarker(trimmed)
+			if marker == "" || len(line)-len(strings.TrimLeft(line, " ")) > 3 {
+				continue
+			}
+
+			fence, content = marker, nil
+			block = parseInfoString(trimmed[len(marker):])
+			continue
+		}
+
+		if strings.HasPrefix(trimmed, fence) && strings.Trim(trimmed, fence[:1]) == "" {
+			block.Content = strings.Join(content, "\n")
+			blocks = append(blocks, block)
+			fence = ""
+			continue
+		}
+
+		content = append(content, line)
+	}
+
+	if fence != "" {
+		block.Content = strings.Join(content, "\n")
+		blocks = append(blocks, block)
+	}
+
+	return blocks
+}
+
+// fenceMarker returns the run of at least three backticks or tildes opening a line.
+func fenceMarker(line string) string {
+	if !strings.HasPrefix(line, "```") && !strings.HasPrefix(line, "~~~") {
+		return ""
+	}
+
+	marker := line[:len(line)-len(strings.TrimLeft(line, line[:1]))]
+	if marker[0] == '`' && strings.Contains(line[len(marker):], "`") {
+		return ""
+	}
+	return marker
+}
+
+func parseInfoString(info string) CodeBlock {
+	block := CodeBlock{Attributes: make(map[string]string)}
+
+	for i, field := range splitInfoString(info) {
+		key, value, found := strings.Cut(field, "=")
+		switch {
+		case found:
+			block.Attributes[strings.ToLower(key)] = strings.Trim(value, `"'`)
+		case i == 0:
+			block.Language = strings.ToLower(strings.Trim(field, "{}."))
+		case strings.Contains(field, "."):
+			block.Attributes["title"] = field
+		}
+	}
+
+	return block
+}
+
+// splitInfoString splits an info string by spaces outside quotes.
+func splitInfoString(info string) []string {
+	var fields []string
+	var field strings.Builder
+	var quote rune
+
+	for _, r := range info {
+		switch {
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote == 0 && (r == '"' || r == '\''):
+			quote = r
+		case quote == 0 && (r == ' ' || r == '\t'):
+			if field.Len() > 0 {
+				fields = append(fields, field.String())
+				field.Reset()
+			}
+			continue
+		}
+		field.WriteRune(r)
+	}
+
+	if field.Len() > 0 {
+		fields = append(fields, field.String())
+	}
+	return fields
+}
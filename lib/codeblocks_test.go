@@ -0,0 +1,43 @@
+package chatfile
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExtractCodeBlocks(t *testing.T) {
+	reply := "Here is the program:\n" +
+		"```go title=main.go\n" +
+		"package main\n" +
+		"\n" +
+		"func main() {}\n" +
+		"```\n" +
+		"And a script:\n" +
+		"~~~sh run.sh\n" +
+		"echo ```\n" +
+		"~~~\n" +
+		"````markdown title=\"read me.md\"\n" +
+		"```\n" +
+		"nested\n" +
+		"```\n" +
+		"````\n" +
+		"Inline ```code``` is not a block.\n" +
+		"```\n" +
+		"cut off"
+
+	expected := []CodeBlock{
+		{"go", map[string]string{"title": "main.go"}, "package main\n\nfunc main() {}"},
+		{"sh", map[string]string{"title": "run.sh"}, "echo ```"},
+		{"markdown", map[string]string{"title": "read me.md"}, "```\nnested\n```"},
+		{"", map[string]string{}, "cut off"},
+	}
+
+	actual := ExtractCodeBlocks(reply)
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("ExtractCodeBlocks() =\n%#v\nexpected\n%#v", actual, expected)
+	}
+
+	if name := actual[2].FileName(); name != "read me.md" {
+		t.Errorf("FileName() = %q, expected %q", name, "read me.md")
+	}
+}
@@ -27,8 +27,9 @@ func (c *FromCommand) Apply(ctx *Context) {
 }
 
 type PromptCommand struct {
-	Role    Role
-	Message string
+	Role       Role
+	Message    string
+	Attributes Attributes
 }
 
 func (c *PromptCommand) Name() CommandName {
@@ -36,5 +37,137 @@ func (c *PromptCommand) Name() CommandName {
 }
 
 func (c *PromptCommand) Apply(ctx *Context) {
-	ctx.History.Append(c.Role, c.Message)
+	choice := ctx.choice
+	ctx.choice = 0
+
+	// Only the first of alternative answers is kept in the history
+	if c.Role == RoleAssistant && choice > 1 {
+		return
+	}
+
+	content, err := ctx.expandPrompt(c.Role, c.Message)
+	if err != nil {
+		ctx.Fail(err)
+		return
+	}
+
+	ctx.appendMessage(Message{c.Role, content, c.Attributes})
+}
+
+// ThoughtCommand keeps the reasoning of a model before its ANSWER.
+// It is never sent back to the model.
+type ThoughtCommand struct {
+	Thought    string
+	Attributes Attributes
+}
+
+func (c *ThoughtCommand) Name() CommandName {
+	return "THOUGHT"
+}
+
+func (c *ThoughtCommand) Apply(*Context) {}
+
+type TruncateCommand struct {
+	Policy TruncatePolicy
+}
+
+func (c *TruncateCommand) Name() CommandName {
+	return "TRUNCATE"
+}
+
+func (c *TruncateCommand) Apply(ctx *Context) {
+	ctx.Truncate = c.Policy
+}
+
+type ExpectCommand struct {
+	Expectation
+}
+
+func (c *ExpectCommand) Name() CommandName {
+	return "EXPECT"
+}
+
+func (c *ExpectCommand) Apply(ctx *Context) {
+	ctx.Expectations = append(ctx.Expectations, c.Expectation)
+}
+
+type ParameterCommand struct {
+	Parameter string
+	Value     string
+}
+
+func (c *ParameterCommand) Name() CommandName {
+	return "PARAMETER"
+}
+
+func (c *ParameterCommand) Apply(ctx *Context) {
+	_ = ctx.Parameters.Set(c.Parameter, c.Value)
+}
+
+// ChoiceCommand tags the following ANSWER as one of several alternative completions.
+type ChoiceCommand struct {
+	Index int
+}
+
+func (c *ChoiceCommand) Name() CommandName {
+	return "CHOICE"
+}
+
+func (c *ChoiceCommand) Apply(ctx *Context) {
+	ctx.choice = c.Index
+}
+
+// LabelCommand names the current point of the conversation, so it can be continued from later.
+type LabelCommand struct {
+	Label string
+}
+
+func (c *LabelCommand) Name() CommandName {
+	return "LABEL"
+}
+
+func (c *LabelCommand) Apply(ctx *Context) {
+	ctx.branches().Label(c.Label)
+}
+
+// ContinueCommand starts a new branch of the conversation at a label.
+type ContinueCommand struct {
+	Label string
+}
+
+func (c *ContinueCommand) Name() CommandName {
+	return "CONTINUE"
+}
+
+func (c *ContinueCommand) Apply(ctx *Context) {
+	ctx.branches().ContinueFrom(c.Label)
+}
+
+// VarCommand declares a variable with its default value.
+// Values provided by the caller before the chatfile is applied take precedence,
+// followed by the positional arguments of the context, consumed in the order variables are declared.
+type VarCommand struct {
+	Variable string
+	Default  string
+}
+
+func (c *VarCommand) Name() CommandName {
+	return "VAR"
+}
+
+func (c *VarCommand) Apply(ctx *Context) {
+	if ctx.Variables == nil {
+		ctx.Variables = make(map[string]string)
+	}
+	if _, found := ctx.Variables[c.Variable]; found {
+		return
+	}
+
+	if len(ctx.Arguments) > 0 {
+		ctx.Variables[c.Variable] = ctx.Arguments[0]
+		ctx.Arguments = ctx.Arguments[1:]
+		return
+	}
+
+	ctx.Variables[c.Variable] = c.Default
 }
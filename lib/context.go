@@ -1,5 +1,12 @@
 package chatfile
 
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+)
+
 type Role string
 
 const (
@@ -8,10 +15,34 @@ const (
 	RoleAssistant Role = "ASSISTANT"
 )
 
+// Message is a single entry of a conversation, independent of any backend representation.
+type Message struct {
+	Role    Role   `json:"role"`
+	Content string `json:"content"`
+
+	// Attributes of the command the message is written with, if any.
+	Attributes Attributes `json:"attributes,omitempty"`
+}
+
 type ChatHistory interface {
 	Append(role Role, message string)
 }
 
+// MessageHistory is a [ChatHistory] keeping the attributes of messages.
+// Histories implementing only [ChatHistory] receive the role and the content.
+type MessageHistory interface {
+	ChatHistory
+	AppendMessage(message Message)
+}
+
+func appendTo(history ChatHistory, message Message) {
+	if h, ok := history.(MessageHistory); ok {
+		h.AppendMessage(message)
+		return
+	}
+	history.Append(message.Role, message.Content)
+}
+
 type ModelName string
 
 // Context represents the mutable state built up as commands from a chatfile
@@ -24,4 +55,146 @@ type ModelName string
 type Context struct {
 	History      ChatHistory
 	CurrentModel ModelName
+
+	// Truncate shortens the history before sending when it exceeds the context window.
+	Truncate TruncatePolicy
+
+	// Expectations are checked against the model's reply after a run.
+	Expectations []Expectation
+
+	// Parameters of the request set with PARAMETER.
+	Parameters RequestParams
+
+	// Variables substituted for ${name} in prompts, declared with VAR or provided by the caller.
+	Variables map[string]string
+
+	// Arguments are positional values bound to variables as they are declared.
+	// The ones left after all commands are applied are up to the caller.
+	Arguments []string
+
+	// Template is the engine rendering prompts, selected with TEMPLATE. Empty means [TemplateNone].
+	Template string
+
+	// Dir is the directory of the chatfile, which paths of templates are relative to.
+	// Empty means the working directory.
+	Dir string
+
+	// Shell lists the programs templates may run with the shell function.
+	Shell []string
+
+	// Env lists the environment variables templates may read.
+	Env []string
+
+	// Paths lists directories besides Dir that templates may read files from.
+	Paths []string
+
+	// calls cancels the calls of command plugins, see [LoadOptions].
+	calls context.Context
+
+	// Branches holds the conversation from the first LABEL on, see [HistoryTree].
+	// Messages before it are shared by all branches and go straight to History.
+	Branches *HistoryTree
+
+	// choice is the index of the alternative answer that follows.
+	choice int
+
+	// flattened are the branches and the label selected by Flatten, kept for Continuation.
+	flattened *HistoryTree
+	branch    string
+
+	// err is the first error of an applied command, reported by Flatten.
+	err error
+
+	// source is the syntax of the command being applied, when known, to report errors at their position.
+	source *SyntaxNode
+}
+
+// Fail records an error of a command that cannot be applied, as commands report no errors themselves.
+// The first recorded error is returned by Flatten.
+func (ctx *Context) Fail(err error) {
+	if ctx.err == nil {
+		ctx.err = err
+	}
+}
+
+// ContextSnapshot is the state of a [Context] at some point of applying a chatfile.
+type ContextSnapshot struct {
+	Model     ModelName         `json:"model"`
+	Params    RequestParams     `json:"params"`
+	Messages  []Message         `json:"messages"`
+	Variables map[string]string `json:"variables"`
+}
+
+// Snapshot returns the state of the context, with the messages of the current branch.
+// The messages of histories without a Messages method are left out.
+func (ctx *Context) Snapshot() ContextSnapshot {
+	var messages []Message
+	if history, ok := ctx.History.(interface{ Messages() []Message }); ok {
+		messages = slices.Clone(history.Messages())
+	}
+	if ctx.Branches != nil {
+		path, _ := ctx.Branches.Path("")
+		messages = append(messages, path...)
+	}
+
+	return ContextSnapshot{ctx.CurrentModel, ctx.Parameters, messages, maps.Clone(ctx.Variables)}
+}
+
+// appendMessage adds a message to the current branch of the conversation.
+func (ctx *Context) appendMessage(message Message) {
+	if ctx.Branches != nil {
+		ctx.Branches.AppendMessage(message)
+		return
+	}
+	appendTo(ctx.History, message)
+}
+
+// branches returns the tree of branches, creating it on first use.
+func (ctx *Context) branches() *HistoryTree {
+	if ctx.Branches == nil {
+		ctx.Branches = NewHistoryTree()
+	}
+	return ctx.Branches
+}
+
+// Flatten appends the messages of the selected branch to History.
+// It is called once all commands are applied. An empty branch selects the one written last.
+func (ctx *Context) Flatten(branch string) error {
+	if ctx.err != nil {
+		return ctx.err
+	}
+
+	if ctx.Branches == nil {
+		if branch != "" {
+			return fmt.Errorf("%w %s", ErrUnknownLabel, branch)
+		}
+		return nil
+	}
+
+	path, err := ctx.Branches.Path(branch)
+	if err != nil {
+		return err
+	}
+
+	for _, message := range path {
+		appendTo(ctx.History, message)
+	}
+
+	ctx.flattened, ctx.branch = ctx.Branches, branch
+	ctx.Branches = nil
+	return nil
+}
+
+// Continuation returns the command to write before commands appended to the chatfile, so they extend
+// the branch selected by Flatten. It is nil when no command is needed, as the branch is the one written last.
+func (ctx *Context) Continuation() (Command, error) {
+	if ctx.flattened == nil || ctx.branch == "" {
+		return nil, nil
+	}
+
+	label, err := ctx.flattened.Continuation(ctx.branch)
+	if err != nil || label == "" {
+		return nil, err
+	}
+	return &ContinueCommand{Label: label}, nil
 }
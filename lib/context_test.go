@@ -37,5 +37,9 @@ func TestContextCollecting(t *testing.T) {
 			command := scanner.Command()
 			command.Apply(context)
 		}
+
+		if err := context.Flatten(""); err != nil {
+			_, _ = fmt.Fprintf(output, "\n%v\n", err)
+		}
 	})
 }
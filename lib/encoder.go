@@ -0,0 +1,211 @@
+package chatfile
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+var ErrUnencodable = errors.New("encoder: command cannot be written as chatfile text")
+
+// CommandMarshaler is implemented by commands unknown to the [Encoder].
+// MarshalCommand returns the keyword of the command, its attributes and the values of its arguments,
+// in the order the keyword reads them.
+type CommandMarshaler interface {
+	Command
+	MarshalCommand() (keyword string, attributes Attributes, arguments []string)
+}
+
+// Encoder writes commands as chatfile text, one command per line or block.
+//
+// Prompts are written on the line of their command when they are read back unchanged,
+// otherwise as a block indented by TabSize spaces, or as a heredoc when even a block would change them,
+// such as with trailing whitespace.
+type Encoder struct {
+	w io.Writer
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w}
+}
+
+// Encode writes a command. Parsing the written text gives an equal command.
+// Values that cannot be written, such as a label with spaces, are reported with [ErrUnencodable].
+func (e *Encoder) Encode(command Command) error {
+	keyword, attributes, arguments, err := marshalCommand(command)
+	if err != nil {
+		return err
+	}
+
+	text, err := formatCommand(keyword, attributes, arguments)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(e.w, text)
+	return err
+}
+
+var promptKeywords = map[Role]TokenType{RoleSystem: SYSTEM, RoleUser: ASK, RoleAssistant: ANSWER}
+
+func marshalCommand(command Command) (string, Attributes, []string, error) {
+	switch c := command.(type) {
+	case *FromCommand:
+		return string(FROM), nil, []string{c.ModelName}, nil
+	case *PromptCommand:
+		keyword, found := promptKeywords[c.Role]
+		if !found {
+			return "", nil, nil, fmt.Errorf("%w: unknown role %s", ErrUnencodable, c.Role)
+		}
+		return string(keyword), c.Attributes, []string{c.Message}, nil
+	case *ThoughtCommand:
+		return string(THOUGHT), c.Attributes, []string{c.Thought}, nil
+	case *TruncateCommand:
+		policy, err := formatTruncatePolicy(c.Policy)
+		return string(TRUNCATE), nil, []string{policy}, err
+	case *ExpectCommand:
+		return string(EXPECT), nil, []string{string(c.Kind), c.Argument}, nil
+	case *ParameterCommand:
+		return string(PARAMETER), nil, []string{c.Parameter, c.Value}, nil
+	case *ChoiceCommand:
+		return string(CHOICE), nil, []string{strconv.Itoa(c.Index)}, nil
+	case *LabelCommand:
+		return string(LABEL), nil, []string{c.Label}, nil
+	case *ContinueCommand:
+		return string(CONTINUE), nil, []string{string(FROM), c.Label}, nil
+	case *VarCommand:
+		return string(VAR), nil, []string{c.Variable, c.Default}, nil
+	case *TemplateCommand:
+		return string(TEMPLATE), nil, []string{c.Engine}, nil
+	case CommandMarshaler:
+		keyword, attributes, arguments := c.MarshalCommand()
+		return keyword, attributes, arguments, nil
+	}
+
+	return "", nil, nil, fmt.Errorf("%w: unknown command %s", ErrUnencodable, command.Name())
+}
+
+func formatTruncatePolicy(policy TruncatePolicy) (string, error) {
+	switch p := policy.(type) {
+	case DropOldest:
+		return "oldest", nil
+	case KeepTurns:
+		return fmt.Sprintf("keep %d %d", p.First, p.Last), nil
+	case Summarize:
+		return strings.TrimSpace(fmt.Sprintf("summarize %d %d %s", p.First, p.Last, p.Model)), nil
+	}
+	return "", fmt.Errorf("%w: unknown truncate policy %T", ErrUnencodable, policy)
+}
+
+// formatCommand writes a keyword and its arguments in the shapes the lexer reads them.
+func formatCommand(keyword string, attributes Attributes, arguments []string) (string, error) {
+	kw, found := lookupKeyword(keyword)
+	if !found {
+		return "", fmt.Errorf("%w: unknown keyword %s", ErrUnencodable, keyword)
+	}
+	if len(arguments) != len(kw.args) {
+		return "", fmt.Errorf("%w: %s takes %d arguments, got %d", ErrUnencodable, keyword, len(kw.args), len(arguments))
+	}
+	if len(kw.args) == 0 && len(attributes) > 0 {
+		return "", fmt.Errorf("%w: %s takes no arguments, so it cannot carry attributes", ErrUnencodable, keyword)
+	}
+
+	var builder strings.Builder
+	builder.WriteString(keyword)
+	if len(attributes) > 0 {
+		builder.WriteString(" " + attributes.String())
+	}
+
+	for i, argument := range arguments {
+		// Without attributes, a first argument starting with a bracketed list would be read as them.
+		ambiguous := i == 0 && len(attributes) == 0 && looksLikeAttributes(argument, len(arguments) > 1)
+
+		switch kw.args[i] {
+		case s_model, s_word:
+			if argument == "" || strings.IndexFunc(argument, unicode.IsSpace) >= 0 || ambiguous {
+				return "", fmt.Errorf("%w: %s argument %q is not a single word", ErrUnencodable, keyword, argument)
+			}
+			builder.WriteString(" " + argument)
+		case s_line:
+			if argument == "" || argument != strings.TrimSpace(argument) || strings.Contains(argument, "\n") || ambiguous {
+				return "", fmt.Errorf("%w: %s argument %q is not a single line", ErrUnencodable, keyword, argument)
+			}
+			builder.WriteString(" " + argument)
+		case s_prompt:
+			builder.WriteString(" " + formatPrompt(argument, ambiguous))
+		}
+	}
+
+	builder.WriteString("\n")
+	return builder.String(), nil
+}
+
+// looksLikeAttributes reports whether the lexer would read the start of an argument as attributes,
+// given whether more arguments follow it on the line.
+func looksLikeAttributes(text string, followed bool) bool {
+	match := attributeList.FindString(text)
+	if match == "" {
+		return false
+	}
+	if rest := text[len(match):]; rest != "" {
+		return followedByArguments([]byte(rest))
+	}
+	return followed
+}
+
+// formatPrompt chooses the shortest form of a prompt that is read back unchanged.
+func formatPrompt(prompt string, ambiguous bool) string {
+	if isSingleLinePrompt(prompt) && !ambiguous {
+		return prompt
+	}
+
+	lines := strings.Split(prompt, "\n")
+	block := prompt != ""
+	for _, line := range lines {
+		block = block && line == strings.TrimRightFunc(line, unicode.IsSpace)
+	}
+
+	var builder strings.Builder
+	if block {
+		builder.WriteString("|")
+		for _, line := range lines {
+			builder.WriteString("\n" + strings.Repeat(" ", TabSize) + line)
+		}
+		return builder.String()
+	}
+
+	terminator := heredocTerminator(lines)
+	builder.WriteString("<<" + terminator + "\n")
+	for _, line := range lines {
+		builder.WriteString(line + "\n")
+	}
+	builder.WriteString(terminator)
+	return builder.String()
+}
+
+func isSingleLinePrompt(prompt string) bool {
+	if prompt == "" || prompt != strings.TrimSpace(prompt) || strings.ContainsAny(prompt, "\r\n") {
+		return false
+	}
+
+	_, block := parseBlockHeader(prompt)
+	return !block && prompt != "|" && !heredocHeader.MatchString(prompt)
+}
+
+// heredocTerminator returns a terminator that none of the lines could be mistaken for.
+func heredocTerminator(lines []string) string {
+	terminator := "EOF"
+	for i := 1; ; i++ {
+		taken := false
+		for _, line := range lines {
+			taken = taken || strings.TrimRightFunc(line, unicode.IsSpace) == terminator
+		}
+		if !taken {
+			return terminator
+		}
+		terminator = "EOF" + strconv.Itoa(i)
+	}
+}
@@ -0,0 +1,95 @@
+package chatfile
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/vorotynsky/chatfile/test"
+)
+
+func encodeCommands(t *testing.T, commands []Command) []byte {
+	var buffer bytes.Buffer
+	encoder := NewEncoder(&buffer)
+	for _, command := range commands {
+		if err := encoder.Encode(command); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buffer.Bytes()
+}
+
+// TestEncoderRoundTrip encodes the commands of every case and parses them again, expecting the same commands.
+func TestEncoderRoundTrip(t *testing.T) {
+	test.DoTest(t, "parsed", func(t *testing.T, input io.Reader, output io.Writer) {
+		source, _ := io.ReadAll(input)
+		tree, err := ParseSyntax(source)
+
+		encoded := encodeCommands(t, tree.Commands())
+		reparsed, reparseErr := ParseSyntax(encoded)
+		if reparseErr != nil {
+			t.Fatalf("encoded commands do not parse: %v\n%s", reparseErr, encoded)
+		}
+
+		for _, command := range reparsed.Commands() {
+			_, _ = fmt.Fprintf(output, "%s: %v\n", command.Name(), command)
+		}
+
+		var syntaxErr *SyntaxError
+		if errors.As(err, &syntaxErr) {
+			_, _ = fmt.Fprintf(output, "\n%v\n%v\n", syntaxErr.Err, syntaxErr.Token)
+		}
+	})
+}
+
+func TestEncoderEscapes(t *testing.T) {
+	prompts := map[string]string{
+		"plain":              "Hello, world!",
+		"pipe":               "|",
+		"block header":       ">+",
+		"heredoc header":     "<<EOF",
+		"attributes":         "[draft] text",
+		"empty":              "",
+		"surrounding spaces": "  text ",
+		"lines":              "first\n\n  second",
+		"trailing spaces":    "first  \nsecond",
+		"trailing newline":   "text\n",
+		"terminator":         "EOF\nEOF1\n",
+	}
+
+	for name, prompt := range prompts {
+		t.Run(name, func(t *testing.T) {
+			commands := []Command{
+				&PromptCommand{Role: RoleUser, Message: prompt},
+				&PromptCommand{Role: RoleAssistant, Message: prompt, Attributes: Attributes{"model": "gpt-4.1"}},
+			}
+
+			encoded := encodeCommands(t, commands)
+			tree, err := ParseSyntax(encoded)
+			if err != nil {
+				t.Fatalf("%v\n%s", err, encoded)
+			}
+			if !reflect.DeepEqual(tree.Commands(), commands) {
+				t.Errorf("parsed %v from\n%s", tree.Commands(), encoded)
+			}
+		})
+	}
+}
+
+func TestEncoderUnencodable(t *testing.T) {
+	commands := []Command{
+		&LabelCommand{"two words"},
+		&ParameterCommand{"[seed]", "1"},
+		&VarCommand{"name", ""},
+		&ParameterCommand{"temperature", "1\n2"},
+	}
+
+	for _, command := range commands {
+		if err := NewEncoder(io.Discard).Encode(command); !errors.Is(err, ErrUnencodable) {
+			t.Errorf("%v: expected %v, got %v", command, ErrUnencodable, err)
+		}
+	}
+}
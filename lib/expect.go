@@ -0,0 +1,271 @@
+package chatfile
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+type ExpectKind string
+
+const (
+	ExpectContains    ExpectKind = "contains"
+	ExpectNotContains ExpectKind = "not-contains"
+	ExpectRegex       ExpectKind = "regex"
+	ExpectJsonSchema  ExpectKind = "json-schema"
+	ExpectJudge       ExpectKind = "judge"
+)
+
+var (
+	ErrUnknownExpectation = errors.New("parser: unknown expectation, expected contains, not-contains, regex, json-schema or judge")
+	ErrExpectationFailed  = errors.New("expectation failed")
+)
+
+// Judge grades a reply against free-form criteria, usually with the help of a second model.
+// It returns whether the reply passes and a short explanation.
+type Judge func(criteria string, reply string) (bool, string, error)
+
+// Expectation is an assertion on the model's reply, declared with EXPECT.
+type Expectation struct {
+	Kind     ExpectKind
+	Argument string
+
+	// regex is the compiled argument of regex expectations made by [NewExpectation].
+	regex *regexp.Regexp
+}
+
+// NewExpectation validates the argument of an expectation, so mistakes are reported while parsing.
+func NewExpectation(kind string, argument string) (Expectation, error) {
+	e := Expectation{Kind: ExpectKind(strings.ToLower(kind)), Argument: argument}
+
+	switch e.Kind {
+	case ExpectContains, ExpectNotContains, ExpectJudge:
+	case ExpectRegex:
+		regex, err := regexp.Compile(argument)
+		if err != nil {
+			return e, fmt.Errorf("parser: invalid regex: %w", err)
+		}
+		e.regex = regex
+	case ExpectJsonSchema:
+		var schema any
+		if err := json.Unmarshal([]byte(argument), &schema); err != nil {
+			return e, fmt.Errorf("parser: invalid json schema: %w", err)
+		}
+	default:
+		return e, ErrUnknownExpectation
+	}
+
+	return e, nil
+}
+
+// String returns the kind and the argument, as written after EXPECT.
+func (e Expectation) String() string {
+	return string(e.Kind) + " " + e.Argument
+}
+
+// Check tests the reply and returns an error wrapping [ErrExpectationFailed] when it does not pass.
+// The judge is used only by judge expectations.
+func (e Expectation) Check(reply string, judge Judge) error {
+	switch e.Kind {
+	case ExpectContains:
+		if !strings.Contains(reply, e.Argument) {
+			return e.fail("reply does not contain %q", e.Argument)
+		}
+
+	case ExpectNotContains:
+		if strings.Contains(reply, e.Argument) {
+			return e.fail("reply contains %q", e.Argument)
+		}
+
+	case ExpectRegex:
+		regex := e.regex
+		if regex == nil {
+			var err error
+			if regex, err = regexp.Compile(e.Argument); err != nil {
+				return fmt.Errorf("expect %s: %w", e.Kind, err)
+			}
+		}
+		if !regex.MatchString(reply) {
+			return e.fail("reply does not match %q", e.Argument)
+		}
+
+	case ExpectJsonSchema:
+		var schema, value any
+		_ = json.Unmarshal([]byte(e.Argument), &schema)
+
+		if err := json.Unmarshal([]byte(stripCodeFence(reply)), &value); err != nil {
+			return e.fail("reply is not valid json: %v", err)
+		}
+		if err := validateSchema(schema, value, "$"); err != nil {
+			return e.fail("%v", err)
+		}
+
+	case ExpectJudge:
+		if judge == nil {
+			return fmt.Errorf("expect %s: no judge configured", e.Kind)
+		}
+
+		passed, reason, err := judge(e.Argument, reply)
+		if err != nil {
+			return fmt.Errorf("expect %s: %w", e.Kind, err)
+		}
+		if !passed {
+			return e.fail("%s", reason)
+		}
+	}
+
+	return nil
+}
+
+func (e Expectation) fail(format string, args ...any) error {
+	return fmt.Errorf("%w: expect %s: %s", ErrExpectationFailed, e.Kind, fmt.Sprintf(format, args...))
+}
+
+// stripCodeFence removes a Markdown code fence around the reply, as models often wrap json in one.
+func stripCodeFence(reply string) string {
+	reply = strings.TrimSpace(reply)
+	if !strings.HasPrefix(reply, "```") || !strings.HasSuffix(reply, "```") {
+		return reply
+	}
+
+	_, body, found := strings.Cut(reply, "\n")
+	if !found {
+		return reply
+	}
+	return strings.TrimSuffix(body, "```")
+}
+
+// validateSchema checks a decoded json value against a subset of JSON Schema:
+// type, enum, const, properties, required, additionalProperties, items,
+// minimum, maximum, minLength, maxLength, pattern, minItems and maxItems.
+func validateSchema(schema any, value any, path string) error {
+	rules, ok := schema.(map[string]any)
+	if !ok {
+		if allowed, isBool := schema.(bool); isBool && !allowed {
+			return fmt.Errorf("%s is not allowed", path)
+		}
+		return nil
+	}
+
+	if types, found := rules["type"]; found && !matchesType(types, value) {
+		return fmt.Errorf("%s should be of type %v", path, types)
+	}
+
+	if enum, found := rules["enum"].([]any); found {
+		matched := false
+		for _, option := range enum {
+			matched = matched || jsonEqual(option, value)
+		}
+		if !matched {
+			return fmt.Errorf("%s should be one of %v", path, enum)
+		}
+	}
+
+	if constant, found := rules["const"]; found && !jsonEqual(constant, value) {
+		return fmt.Errorf("%s should be %v", path, constant)
+	}
+
+	switch v := value.(type) {
+	case map[string]any:
+		if required, found := rules["required"].([]any); found {
+			for _, name := range required {
+				if _, present := v[fmt.Sprint(name)]; !present {
+					return fmt.Errorf("%s.%v is required", path, name)
+				}
+			}
+		}
+
+		properties, _ := rules["properties"].(map[string]any)
+		for name, property := range v {
+			if propertySchema, found := properties[name]; found {
+				if err := validateSchema(propertySchema, property, path+"."+name); err != nil {
+					return err
+				}
+			} else if additional, found := rules["additionalProperties"]; found {
+				if err := validateSchema(additional, property, path+"."+name); err != nil {
+					return err
+				}
+			}
+		}
+
+	case []any:
+		if minItems, found := rules["minItems"].(float64); found && float64(len(v)) < minItems {
+			return fmt.Errorf("%s should have at least %v items", path, minItems)
+		}
+		if maxItems, found := rules["maxItems"].(float64); found && float64(len(v)) > maxItems {
+			return fmt.Errorf("%s should have at most %v items", path, maxItems)
+		}
+		if items, found := rules["items"]; found {
+			for i, item := range v {
+				if err := validateSchema(items, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+
+	case string:
+		length := float64(utf8.RuneCountInString(v))
+		if minLength, found := rules["minLength"].(float64); found && length < minLength {
+			return fmt.Errorf("%s should be at least %v characters long", path, minLength)
+		}
+		if maxLength, found := rules["maxLength"].(float64); found && length > maxLength {
+			return fmt.Errorf("%s should be at most %v characters long", path, maxLength)
+		}
+		if pattern, found := rules["pattern"].(string); found {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return fmt.Errorf("%s: invalid pattern: %w", path, err)
+			}
+			if !re.MatchString(v) {
+				return fmt.Errorf("%s should match %q", path, pattern)
+			}
+		}
+
+	case float64:
+		if minimum, found := rules["minimum"].(float64); found && v < minimum {
+			return fmt.Errorf("%s should be at least %v", path, minimum)
+		}
+		if maximum, found := rules["maximum"].(float64); found && v > maximum {
+			return fmt.Errorf("%s should be at most %v", path, maximum)
+		}
+	}
+
+	return nil
+}
+
+func matchesType(types any, value any) bool {
+	if list, ok := types.([]any); ok {
+		for _, t := range list {
+			if matchesType(t, value) {
+				return true
+			}
+		}
+		return false
+	}
+
+	switch v := value.(type) {
+	case nil:
+		return types == "null"
+	case bool:
+		return types == "boolean"
+	case string:
+		return types == "string"
+	case float64:
+		return types == "number" || (types == "integer" && v == math.Trunc(v))
+	case []any:
+		return types == "array"
+	case map[string]any:
+		return types == "object"
+	}
+	return false
+}
+
+func jsonEqual(left any, right any) bool {
+	l, _ := json.Marshal(left)
+	r, _ := json.Marshal(right)
+	return string(l) == string(r)
+}
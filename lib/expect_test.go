@@ -0,0 +1,83 @@
+package chatfile
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestExpectationCheck(t *testing.T) {
+	schema := `{
+		"type": "object",
+		"required": ["name", "tags"],
+		"properties": {
+			"name": {"type": "string", "minLength": 2},
+			"age": {"type": "integer", "minimum": 0},
+			"tags": {"type": "array", "items": {"enum": ["a", "b"]}, "maxItems": 2}
+		},
+		"additionalProperties": false
+	}`
+
+	cases := []struct {
+		kind     ExpectKind
+		argument string
+		reply    string
+		passed   bool
+	}{
+		{ExpectContains, "Paris", "The capital is Paris.", true},
+		{ExpectContains, "Paris", "The capital is Lyon.", false},
+		{ExpectNotContains, "London", "The capital is Paris.", true},
+		{ExpectNotContains, "Paris", "The capital is Paris.", false},
+		{ExpectRegex, `^\d+$`, "42", true},
+		{ExpectRegex, `^\d+$`, "forty two", false},
+		{ExpectJsonSchema, schema, `{"name": "Bob", "age": 3, "tags": ["a"]}`, true},
+		{ExpectJsonSchema, schema, "```json\n{\"name\": \"Bob\", \"tags\": []}\n```", true},
+		{ExpectJsonSchema, schema, `{"name": "Bob"}`, false},
+		{ExpectJsonSchema, schema, `{"name": "B", "tags": []}`, false},
+		{ExpectJsonSchema, schema, `{"name": "Bob", "age": 1.5, "tags": []}`, false},
+		{ExpectJsonSchema, schema, `{"name": "Bob", "tags": ["c"]}`, false},
+		{ExpectJsonSchema, schema, `{"name": "Bob", "tags": [], "extra": 1}`, false},
+		{ExpectJsonSchema, schema, `not json`, false},
+	}
+
+	for _, c := range cases {
+		expectation, err := NewExpectation(string(c.kind), c.argument)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = expectation.Check(c.reply, nil)
+		if c.passed && err != nil {
+			t.Errorf("%s %q on %q: unexpected error %v", c.kind, c.argument, c.reply, err)
+		}
+		if !c.passed && !errors.Is(err, ErrExpectationFailed) {
+			t.Errorf("%s %q on %q: expected failure, got %v", c.kind, c.argument, c.reply, err)
+		}
+	}
+}
+
+func TestExpectationInvalidRegex(t *testing.T) {
+	if _, err := NewExpectation("regex", "(unclosed"); err == nil {
+		t.Error("expected an error for an invalid regex")
+	}
+
+	// Expectations made without NewExpectation report the pattern instead of panicking.
+	err := Expectation{Kind: ExpectRegex, Argument: "(unclosed"}.Check("reply", nil)
+	if err == nil || errors.Is(err, ErrExpectationFailed) {
+		t.Errorf("expected an invalid regex error, got %v", err)
+	}
+}
+
+func TestExpectationJudge(t *testing.T) {
+	expectation, _ := NewExpectation("JUDGE", "is polite")
+
+	judge := func(criteria string, reply string) (bool, string, error) {
+		return reply == "please", "not polite", nil
+	}
+
+	if err := expectation.Check("please", judge); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err := expectation.Check("go away", judge); !errors.Is(err, ErrExpectationFailed) {
+		t.Errorf("expected failure, got %v", err)
+	}
+}
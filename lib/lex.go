@@ -2,10 +2,14 @@ package chatfile
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
+	"fmt"
 	"io"
+	"regexp"
 	"strings"
 	"unicode"
+	"unicode/utf8"
 )
 
 type TokenType string
@@ -18,7 +22,23 @@ const (
 	SYSTEM  TokenType = "SYSTEM"
 	ASK     TokenType = "ASK"
 	ANSWER  TokenType = "ANSWER"
+	THOUGHT TokenType = "THOUGHT"
 	PROMPT  TokenType = "PROMPT"
+
+	TRUNCATE  TokenType = "TRUNCATE"
+	EXPECT    TokenType = "EXPECT"
+	PARAMETER TokenType = "PARAMETER"
+	CHOICE    TokenType = "CHOICE"
+	LABEL     TokenType = "LABEL"
+	CONTINUE  TokenType = "CONTINUE"
+	VAR       TokenType = "VAR"
+	TEMPLATE  TokenType = "TEMPLATE"
+	ATTRS     TokenType = "ATTRS"
+
+	// TRIVIA is whitespace kept by the concrete syntax tree, see [ParseSyntax]. The lexer never emits it.
+	TRIVIA TokenType = "TRIVIA"
+	WORD   TokenType = "WORD"
+	LINE   TokenType = "LINE"
 )
 
 const TabSize = 4
@@ -28,6 +48,10 @@ var (
 	ErrUnexpectedEOF     = errors.New("lexer: unexepected eof")
 	ErrExpectedPrompt    = errors.New("lexer: prompt must be on the same line as SYSTEM/ASK/ANSWER")
 	ErrExpectedModelName = errors.New("lexer: model name must be on the same line as FROM")
+	ErrExpectedArguments = errors.New("lexer: arguments must be on the same line as the command")
+	ErrBlockIndentation  = fmt.Errorf("lexer: lines of a block prompt must be indented by at least %d spaces or a tab, "+
+		"or by the number of spaces given after | or >", TabSize)
+	ErrUnterminatedHeredoc = errors.New("lexer: heredoc prompt must end with a line holding only its terminator")
 )
 
 // Token represents a single lexical unit extracted during the lexical analysis process.
@@ -67,20 +91,55 @@ const (
 	s_ready = iota
 	s_model
 	s_prompt
+	s_word
+	s_line
 )
 
+// keyword describes a command token and the states lexing its arguments, in order.
+type keyword struct {
+	token TokenType
+	args  []int
+}
+
+var keywords = map[string]keyword{
+	"FROM":     {FROM, []int{s_model}},
+	"SYSTEM":   {SYSTEM, []int{s_prompt}},
+	"ASK":      {ASK, []int{s_prompt}},
+	"ANSWER":   {ANSWER, []int{s_prompt}},
+	"THOUGHT":  {THOUGHT, []int{s_prompt}},
+	"TRUNCATE": {TRUNCATE, []int{s_line}},
+	"EXPECT":   {EXPECT, []int{s_word, s_prompt}},
+
+	"PARAMETER": {PARAMETER, []int{s_word, s_line}},
+	"CHOICE":    {CHOICE, []int{s_word}},
+
+	"LABEL":    {LABEL, []int{s_word}},
+	"CONTINUE": {CONTINUE, []int{s_word, s_word}},
+
+	"VAR":      {VAR, []int{s_word, s_line}},
+	"TEMPLATE": {TEMPLATE, []int{s_word}},
+}
+
 type ReaderLexer struct {
-	r     *bufio.Reader
-	state int
-	err   error
-	ln    int
-	col   int
-	cur   Token
+	r       *sourceReader
+	started bool
+	keyword bool
+	state   int
+	pending []int
+	err     error
+	ln      int
+	col     int
+	cur     Token
+
+	// start and end are the byte offsets of the source text of the current token.
+	// Readers set end when the token ends before the input they have consumed, otherwise it is -1.
+	start int
+	end   int
 }
 
 func NewLexer(reader *bufio.Reader) Lexer {
 	return &ReaderLexer{
-		r:  reader,
+		r:  &sourceReader{Reader: reader},
 		ln: 1, col: 1,
 		err: nil,
 		cur: Token{EOF, "", 1, 1},
@@ -95,16 +154,34 @@ func (l *ReaderLexer) Err() error {
 	return l.err
 }
 
+// Span returns the byte offsets of the source text of the current token, without the trailing whitespace.
+// For a block prompt it spans the whole block, from its | or > to the end of its last line.
+func (l *ReaderLexer) Span() (start int, end int) {
+	if l.end < 0 {
+		return l.start, l.r.offset
+	}
+	return l.start, l.end
+}
+
 func (l *ReaderLexer) MoveNext() bool {
 	if l.err != nil {
 		return false
 	}
 
+	if !l.started {
+		l.started = true
+		if err := l.skipShebang(); err != nil && err != io.EOF {
+			l.err = err
+			return false
+		}
+	}
+
 	prevLine := l.ln
 
 	err := l.skip()
 
 	sLn, sCol := l.ln, l.col
+	l.start, l.end = l.r.offset, -1
 
 	if err == io.EOF {
 		l.cur = Token{EOF, "", sLn, sCol}
@@ -116,6 +193,15 @@ func (l *ReaderLexer) MoveNext() bool {
 		return false
 	}
 
+	if l.keyword && prevLine == l.ln {
+		l.keyword = false
+		if attributes, found := l.readAttributes(); found {
+			l.cur = Token{ATTRS, attributes, sLn, sCol}
+			return true
+		}
+	}
+	l.keyword = false
+
 	switch l.state {
 	case s_ready:
 		word, err := l.readWord()
@@ -126,25 +212,17 @@ func (l *ReaderLexer) MoveNext() bool {
 
 		command := strings.ToUpper(word)
 
-		switch command {
-		case "FROM":
-			l.cur = Token{FROM, command, sLn, sCol}
-			l.state = s_model
-		case "SYSTEM":
-			l.cur = Token{SYSTEM, command, sLn, sCol}
-			l.state = s_prompt
-		case "ASK":
-			l.cur = Token{ASK, command, sLn, sCol}
-			l.state = s_prompt
-		case "ANSWER":
-			l.cur = Token{ANSWER, command, sLn, sCol}
-			l.state = s_prompt
-		default:
+		kw, found := lookupKeyword(command)
+		if !found {
 			l.cur = Token{UNKNOWN, word, sLn, sCol}
 			l.err = ErrUnknownToken
 			return false
 		}
 
+		l.cur = Token{kw.token, command, sLn, sCol}
+		l.pending = kw.args
+		l.keyword = true
+		l.nextState()
 		return true
 
 	case s_model:
@@ -161,7 +239,7 @@ func (l *ReaderLexer) MoveNext() bool {
 		}
 
 		l.cur = Token{MODEL, word, sLn, sCol}
-		l.state = s_ready
+		l.nextState()
 		return true
 
 	case s_prompt:
@@ -185,7 +263,30 @@ func (l *ReaderLexer) MoveNext() bool {
 
 		firstLine = strings.TrimRightFunc(firstLine, unicode.IsSpace)
 
-		if firstLine == "|" {
+		if match := heredocHeader.FindStringSubmatch(firstLine); match != nil {
+			prompt, err := l.readHeredoc(match[1])
+			if err != nil {
+				l.setErr(err)
+				if err == io.EOF {
+					l.err = fmt.Errorf("%w %s", ErrUnterminatedHeredoc, match[1])
+				}
+				return false
+			}
+
+			l.cur = Token{PROMPT, prompt, sLn, sCol}
+			l.nextState()
+			return true
+		} else if header, found := parseBlockHeader(firstLine); found {
+			prompt, err := l.readBlock(header)
+			if err != nil {
+				l.setErr(err)
+				return false
+			}
+
+			l.cur = Token{PROMPT, prompt, sLn, sCol}
+			l.nextState()
+			return true
+		} else if firstLine == "|" {
 			prompt, err := l.readIndentedLines()
 			if err != nil {
 				l.setErr(err)
@@ -193,18 +294,66 @@ func (l *ReaderLexer) MoveNext() bool {
 			}
 
 			l.cur = Token{PROMPT, prompt, sLn, sCol}
-			l.state = s_ready
+			l.nextState()
 			return true
 		} else {
+			l.end = l.start + len(firstLine)
 			l.cur = Token{PROMPT, firstLine, sLn, sCol}
-			l.state = s_ready
+			l.nextState()
 			return true
 		}
+
+	case s_word:
+		if prevLine != l.ln {
+			l.err = ErrExpectedArguments
+			l.cur = Token{UNKNOWN, "", sLn, sCol}
+			return false
+		}
+
+		word, err := l.readWord()
+		if err != nil {
+			l.setErr(err)
+			return false
+		}
+
+		l.cur = Token{WORD, word, sLn, sCol}
+		l.nextState()
+		return true
+
+	case s_line:
+		if prevLine != l.ln {
+			l.err = ErrExpectedArguments
+			l.cur = Token{UNKNOWN, "", sLn, sCol}
+			return false
+		}
+
+		line, err := l.readLine()
+		if err != nil {
+			l.setErr(err)
+			return false
+		}
+
+		line = strings.TrimRightFunc(line, unicode.IsSpace)
+		l.end = l.start + len(line)
+		l.cur = Token{LINE, line, sLn, sCol}
+		l.nextState()
+		return true
 	}
 
 	return false
 }
 
+// nextState switches to the next pending argument or back to reading commands.
+func (l *ReaderLexer) nextState() {
+	if len(l.pending) == 0 {
+		l.state = s_ready
+		return
+	}
+
+	l.state = l.pending[0]
+	l.pending = l.pending[1:]
+}
+
 func (l *ReaderLexer) setErr(err error) {
 	if err == io.EOF {
 		l.err = ErrUnexpectedEOF
@@ -214,6 +363,54 @@ func (l *ReaderLexer) setErr(err error) {
 	}
 }
 
+// skipShebang skips the first line when it starts with #!, so chatfiles can be executable scripts.
+func (l *ReaderLexer) skipShebang() error {
+	prefix, err := l.r.Peek(2)
+	if err != nil || string(prefix) != "#!" {
+		return err
+	}
+
+	_, err = l.readLine()
+	return err
+}
+
+// readAttributes reads a bracketed attribute list at the current position, as in ASK [cache] |.
+// The list must be followed by a space and the arguments of the command, otherwise nothing is read,
+// so prompts like ASK [1, 2, 3], ASK [draft]: or ASK [important] are left untouched.
+func (l *ReaderLexer) readAttributes() (string, bool) {
+	line := l.peekLine()
+	if len(line) == 0 || line[0] != '[' {
+		return "", false
+	}
+
+	match := attributeList.Find(line)
+	if match == nil || !followedByArguments(line[len(match):]) {
+		return "", false
+	}
+
+	_, _ = l.r.Discard(len(match))
+	l.col += utf8.RuneCount(match)
+	return strings.TrimSpace(string(match[1 : len(match)-1])), true
+}
+
+// followedByArguments reports whether the rest of a line after an attribute list holds the arguments of the command.
+func followedByArguments(rest []byte) bool {
+	return len(rest) > 0 && unicode.IsSpace(rune(rest[0])) && len(bytes.TrimSpace(rest)) > 0
+}
+
+// peekLine returns the rest of the current line without consuming it, up to the size of the buffer.
+func (l *ReaderLexer) peekLine() []byte {
+	for n := 64; ; n *= 2 {
+		data, err := l.r.Peek(n)
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			return data[:i]
+		}
+		if err != nil {
+			return data
+		}
+	}
+}
+
 // skip all whitespaces and new lines
 func (l *ReaderLexer) skip() error {
 	var err error
@@ -323,10 +520,15 @@ func (l *ReaderLexer) readIndentedLines() (string, error) {
 			}
 		}
 
+		if indentLevel < TabSize && isFirstLine {
+			l.cur = Token{UNKNOWN, "", l.ln, l.col}
+			return "", ErrBlockIndentation
+		}
 		if indentLevel < TabSize {
 			break
 		}
 
+		lineStart := l.r.offset
 		line, err := l.readLine()
 		if err == io.EOF {
 			if promptBuilder.Len() > 0 {
@@ -341,9 +543,254 @@ func (l *ReaderLexer) readIndentedLines() (string, error) {
 		if !isFirstLine {
 			promptBuilder.WriteRune('\n')
 		}
-		promptBuilder.WriteString(strings.TrimRightFunc(line, unicode.IsSpace))
+		line = strings.TrimRightFunc(line, unicode.IsSpace)
+		promptBuilder.WriteString(line)
+		l.end = lineStart + len(line)
 		isFirstLine = false
 	}
 
 	return promptBuilder.String(), nil
 }
+
+var heredocHeader = regexp.MustCompile(`^<<([A-Za-z_][A-Za-z0-9_]*)$`)
+
+// readHeredoc reads the lines of a prompt started with <<TERMINATOR verbatim, up to a line holding only the terminator.
+// The line break before the terminator ends the last line and is not a part of the prompt.
+// It returns io.EOF when the input ends before the terminator.
+func (l *ReaderLexer) readHeredoc(terminator string) (string, error) {
+	if r, _, err := l.r.ReadRune(); err != nil || r != '\n' {
+		return "", errOr(err, io.EOF)
+	}
+	l.ln++
+	l.col = 1
+
+	var lines []string
+	for {
+		lineStart := l.r.offset
+		data, err := l.r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+
+		line := strings.TrimSuffix(strings.TrimSuffix(data, "\n"), "\r")
+		if strings.TrimRightFunc(line, unicode.IsSpace) == terminator {
+			l.end = lineStart + len(terminator)
+			l.col += utf8.RuneCountInString(line)
+			if strings.HasSuffix(data, "\n") {
+				_ = l.r.UnreadByte()
+			}
+			return strings.Join(lines, "\n"), nil
+		}
+
+		if err == io.EOF {
+			return "", io.EOF
+		}
+
+		lines = append(lines, line)
+		l.ln++
+	}
+}
+
+// blockHeader describes a block prompt started with | or > followed by optional indicators, as in YAML.
+//
+//	|   lines with trailing whitespace trimmed, without a final newline
+//	|-  lines kept exactly, including blank ones, without a final newline
+//	|+  lines kept exactly, with the final newline and trailing blank lines
+//	>   lines folded into one, blank lines separate paragraphs; >- and >+ chomp as above
+//	|2  lines indented by 2 spaces instead of TabSize; combined as |2- or |-2
+type blockHeader struct {
+	folded bool
+	keep   bool
+	indent int
+}
+
+var blockHeaderPattern = regexp.MustCompile(`^([|>])(?:([-+])([1-9])?|([1-9])([-+])?)?$`)
+
+// parseBlockHeader recognizes the block indicators, except a bare |, which is read by [ReaderLexer.readIndentedLines].
+func parseBlockHeader(line string) (blockHeader, bool) {
+	match := blockHeaderPattern.FindStringSubmatch(line)
+	if match == nil || line == "|" {
+		return blockHeader{}, false
+	}
+
+	header := blockHeader{folded: match[1] == ">", keep: match[2] == "+" || match[5] == "+", indent: TabSize}
+	if digit := match[3] + match[4]; digit != "" {
+		header.indent = int(digit[0] - '0')
+	}
+	return header, true
+}
+
+// readBlock reads the lines of a block prompt indented by at least header.indent columns, a tab counting as TabSize.
+// Blank lines belong to the block, the first non-blank line indented less ends it.
+func (l *ReaderLexer) readBlock(header blockHeader) (string, error) {
+	if r, _, err := l.r.ReadRune(); err != nil || r != '\n' {
+		return "", errOr(err, io.EOF)
+	}
+	l.ln++
+	l.col = 1
+
+	var lines []string
+	content := 0
+	for {
+		if _, err := l.r.Peek(1); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return "", err
+		}
+
+		next := string(l.peekLine())
+		blank := strings.TrimSpace(next) == ""
+		if columns, _ := indentation(next, header.indent); !blank && columns < header.indent {
+			break
+		}
+
+		lineStart := l.r.offset
+		data, err := l.r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+
+		line := strings.TrimSuffix(strings.TrimSuffix(data, "\n"), "\r")
+		if !blank {
+			l.end = lineStart + len(line)
+		}
+		if strings.HasSuffix(data, "\n") {
+			l.ln++
+			l.col = 1
+		} else {
+			l.col += utf8.RuneCountInString(line)
+		}
+
+		lines = append(lines, unindent(line, header.indent))
+		if !blank {
+			content = len(lines)
+		}
+	}
+
+	if content == 0 {
+		l.cur = Token{UNKNOWN, "", l.ln, l.col}
+		return "", ErrBlockIndentation
+	}
+
+	var prompt string
+	if header.folded {
+		prompt = fold(lines[:content])
+	} else {
+		prompt = strings.Join(lines[:content], "\n")
+	}
+
+	if header.keep {
+		prompt += "\n"
+		for _, line := range lines[content:] {
+			if !header.folded {
+				prompt += line
+			}
+			prompt += "\n"
+		}
+	}
+
+	return prompt, nil
+}
+
+// indentation counts the leading columns of a line up to limit, and the bytes they take.
+func indentation(line string, limit int) (columns int, width int) {
+	for width < len(line) && columns < limit {
+		switch line[width] {
+		case ' ':
+			columns++
+		case '\t':
+			columns += TabSize
+		default:
+			return
+		}
+		width++
+	}
+	return
+}
+
+// unindent removes the indentation of a block line, keeping the columns of a tab that go past it.
+func unindent(line string, indent int) string {
+	columns, width := indentation(line, indent)
+	return strings.Repeat(" ", max(columns-indent, 0)) + line[width:]
+}
+
+// fold joins lines into paragraphs separated by blank lines, as YAML folded blocks.
+// Lines indented more than the block are kept on their own.
+func fold(lines []string) string {
+	var builder strings.Builder
+
+	indented := func(line string) bool {
+		return line != "" && unicode.IsSpace(rune(line[0]))
+	}
+
+	previous := ""
+	for i, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			line = ""
+		} else if !indented(line) {
+			line = strings.TrimRightFunc(line, unicode.IsSpace)
+		}
+
+		if i > 0 {
+			switch {
+			case previous == "" || line == "":
+			case indented(previous) || indented(line):
+				builder.WriteByte('\n')
+			default:
+				builder.WriteByte(' ')
+			}
+		}
+
+		if line == "" {
+			builder.WriteByte('\n')
+		} else {
+			builder.WriteString(line)
+		}
+		previous = line
+	}
+
+	return builder.String()
+}
+
+// sourceReader counts the bytes consumed from the source, so tokens know their offsets.
+type sourceReader struct {
+	*bufio.Reader
+	offset int
+	last   int
+}
+
+func (r *sourceReader) ReadRune() (rune, int, error) {
+	c, size, err := r.Reader.ReadRune()
+	r.offset += size
+	r.last = size
+	return c, size, err
+}
+
+func (r *sourceReader) UnreadRune() error {
+	err := r.Reader.UnreadRune()
+	if err == nil {
+		r.offset -= r.last
+	}
+	return err
+}
+
+func (r *sourceReader) ReadString(delim byte) (string, error) {
+	s, err := r.Reader.ReadString(delim)
+	r.offset += len(s)
+	return s, err
+}
+
+func (r *sourceReader) UnreadByte() error {
+	err := r.Reader.UnreadByte()
+	if err == nil {
+		r.offset--
+	}
+	return err
+}
+
+func (r *sourceReader) Discard(n int) (int, error) {
+	discarded, err := r.Reader.Discard(n)
+	r.offset += discarded
+	return discarded, err
+}
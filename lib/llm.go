@@ -3,78 +3,374 @@ package chatfile
 import (
 	"context"
 	"errors"
+	"fmt"
 	"io"
+	"iter"
+	"slices"
+	"strconv"
+	"strings"
 
 	"github.com/sashabaranov/go-openai"
 )
 
 type OpenAiHistory struct {
-	messages []openai.ChatCompletionMessage
+	messages []Message
 }
 
 func (h *OpenAiHistory) Append(role Role, message string) {
-	var apiRole string
-
-	switch role {
-	case RoleSystem:
-		apiRole = openai.ChatMessageRoleSystem
-	case RoleUser:
-		apiRole = openai.ChatMessageRoleUser
-	case RoleAssistant:
-		apiRole = openai.ChatMessageRoleAssistant
-	}
+	h.AppendMessage(Message{Role: role, Content: message})
+}
 
-	h.messages = append(h.messages, openai.ChatCompletionMessage{Role: apiRole, Content: message})
+func (h *OpenAiHistory) AppendMessage(message Message) {
+	h.messages = append(h.messages, message)
 }
 
 func (h *OpenAiHistory) PrependHistory(header OpenAiHistory) {
 	h.messages = append(header.messages, h.messages...)
 }
 
-type RequestParams struct {
-	Seed        *int
-	Temperature float32
-}
-
-// Send a streaming request and write the response content to the provided writer in chunks as they arrive.
-func Send(client *openai.Client, model ModelName, history OpenAiHistory, writer io.StringWriter, params RequestParams) (err error) {
-	stream, err := client.CreateChatCompletionStream(
-		context.Background(),
-		openai.ChatCompletionRequest{
-			Model:       string(model),
-			Messages:    history.messages,
-			Temperature: params.Temperature,
-			Seed:        params.Seed,
-		},
-	)
+// Attach adds a text to the last question, or as a new question when the conversation does not end with one.
+func (h *OpenAiHistory) Attach(text string) {
+	if last := len(h.messages) - 1; last >= 0 && h.messages[last].Role == RoleUser {
+		h.messages[last].Content += "\n\n" + text
+		return
+	}
+	h.Append(RoleUser, text)
+}
 
+// Messages returns the collected messages in the order they will be sent.
+func (h *OpenAiHistory) Messages() []Message {
+	return h.messages
+}
+
+// Truncate applies the policy when the messages do not fit and returns the indices of the dropped ones.
+func (h *OpenAiHistory) Truncate(policy TruncatePolicy, fits func([]Message) bool, summarize Summarizer) ([]int, error) {
+	if policy == nil || fits(h.messages) {
+		return nil, nil
+	}
+
+	kept, dropped, err := policy.Truncate(h.messages, fits, summarize)
 	if err != nil {
-		return
+		return nil, err
 	}
 
-	defer func(stream *openai.ChatCompletionStream) {
-		err = errors.Join(
-			err,
-			stream.Close(),
-		)
-	}(stream)
+	h.messages = kept
+	return dropped, nil
+}
+
+// ApiMessages converts the messages to the representation of the OpenAI API.
+func (h *OpenAiHistory) ApiMessages() []openai.ChatCompletionMessage {
+	messages := make([]openai.ChatCompletionMessage, 0, len(h.messages))
+
+	for _, message := range h.messages {
+		var apiRole string
 
-	for chunk, err := stream.Recv(); err == nil; chunk, err = stream.Recv() {
-		if len(chunk.Choices) > 0 {
-			_, err = writer.WriteString(chunk.Choices[0].Delta.Content)
+		switch message.Role {
+		case RoleSystem:
+			apiRole = openai.ChatMessageRoleSystem
+		case RoleUser:
+			apiRole = openai.ChatMessageRoleUser
+		case RoleAssistant:
+			apiRole = openai.ChatMessageRoleAssistant
 		}
+
+		messages = append(messages, openai.ChatCompletionMessage{Role: apiRole, Content: message.Content, Name: message.Attributes[AttributeName]})
 	}
 
-	return
+	return messages
 }
 
-func NewParameters(seed *int, temperature *float32) (p RequestParams) {
+var (
+	ErrUnknownParameter = errors.New("parser: unknown parameter")
+)
+
+type RequestParams struct {
+	Seed        *int    `json:"seed,omitempty"`
+	Temperature float32 `json:"temperature,omitempty"`
+	MaxTokens   int     `json:"max_tokens,omitempty"`
+	N           int     `json:"n,omitempty"`
+
+	// ReasoningEffort and MaxCompletionTokens are understood by reasoning models.
+	// MaxCompletionTokens limits the generated tokens including the reasoning ones.
+	ReasoningEffort     string `json:"reasoning_effort,omitempty"`
+	MaxCompletionTokens int    `json:"max_completion_tokens,omitempty"`
+
+	// IncludeUsage asks for an [EventUsage] at the end of the reply.
+	// It is sent as stream_options, which some OpenAI compatible services reject, so it is off by default.
+	IncludeUsage bool `json:"-"`
+}
+
+var reasoningEfforts = []string{"minimal", "low", "medium", "high"}
+
+// Set assigns a parameter by the name used in PARAMETER commands.
+func (p *RequestParams) Set(name string, value string) error {
+	invalid := func(err error) error {
+		return fmt.Errorf("parser: invalid value of parameter %s: %w", name, err)
+	}
+
+	switch strings.ToLower(name) {
+	case "temperature":
+		temperature, err := strconv.ParseFloat(value, 32)
+		if err != nil {
+			return invalid(err)
+		}
+		p.Temperature = float32(temperature)
+	case "seed":
+		seed, err := strconv.Atoi(value)
+		if err != nil {
+			return invalid(err)
+		}
+		p.Seed = &seed
+	case "max_tokens":
+		maxTokens, err := strconv.Atoi(value)
+		if err != nil {
+			return invalid(err)
+		}
+		p.MaxTokens = maxTokens
+	case "n":
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return invalid(err)
+		}
+		if n < 1 {
+			return invalid(errors.New("must be positive"))
+		}
+		p.N = n
+	case "reasoning_effort":
+		effort := strings.ToLower(value)
+		if !slices.Contains(reasoningEfforts, effort) {
+			return invalid(fmt.Errorf("expected one of %s", strings.Join(reasoningEfforts, ", ")))
+		}
+		p.ReasoningEffort = effort
+	case "max_completion_tokens":
+		maxTokens, err := strconv.Atoi(value)
+		if err != nil {
+			return invalid(err)
+		}
+		p.MaxCompletionTokens = maxTokens
+	default:
+		return fmt.Errorf("%w %s", ErrUnknownParameter, name)
+	}
+
+	return nil
+}
+
+func (p RequestParams) request(model ModelName, history OpenAiHistory) openai.ChatCompletionRequest {
+	request := openai.ChatCompletionRequest{
+		Model:       string(model),
+		Messages:    history.ApiMessages(),
+		MaxTokens:   p.MaxTokens,
+		Temperature: p.Temperature,
+		Seed:        p.Seed,
+		N:           p.N,
+
+		ReasoningEffort:     p.ReasoningEffort,
+		MaxCompletionTokens: p.MaxCompletionTokens,
+	}
+
+	if p.IncludeUsage {
+		request.StreamOptions = &openai.StreamOptions{IncludeUsage: true}
+	}
+	return request
+}
+
+type EventType string
+
+const (
+	EventDelta     EventType = "delta"
+	EventReasoning EventType = "reasoning"
+	EventFinish    EventType = "finish"
+	EventUsage     EventType = "usage"
+)
+
+// Usage is the number of tokens spent on a request, as reported by the provider.
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// Event is a piece of a streamed reply.
+// Choice is the index of the completion the event belongs to, when several are requested.
+// A reasoning event carries the thinking of a reasoning model, streamed before the content of the choice.
+// A finish event ends a choice with the reason reported by the provider, such as stop or length.
+type Event struct {
+	Type         EventType
+	Choice       int
+	Content      string
+	FinishReason string
+	Usage        Usage
+}
+
+// Stream sends a streaming request and yields the events of the response as they arrive.
+// Iteration stops after the first error, including the one of a canceled ctx.
+func Stream(ctx context.Context, client *openai.Client, model ModelName, history OpenAiHistory, params RequestParams) iter.Seq2[Event, error] {
+	return func(yield func(Event, error) bool) {
+		stream, err := client.CreateChatCompletionStream(ctx, params.request(model, history))
+		if err != nil {
+			yield(Event{}, err)
+			return
+		}
+
+		defer func(stream *openai.ChatCompletionStream) {
+			_ = stream.Close()
+		}(stream)
+
+		for {
+			chunk, err := stream.Recv()
+			if errors.Is(err, io.EOF) {
+				return
+			}
+			if err != nil {
+				yield(Event{}, err)
+				return
+			}
+
+			for _, choice := range chunk.Choices {
+				if choice.Delta.ReasoningContent != "" && !yield(Event{Type: EventReasoning, Choice: choice.Index, Content: choice.Delta.ReasoningContent}, nil) {
+					return
+				}
+				if choice.Delta.Content != "" && !yield(Event{Type: EventDelta, Choice: choice.Index, Content: choice.Delta.Content}, nil) {
+					return
+				}
+				if choice.FinishReason != "" && !yield(Event{Type: EventFinish, Choice: choice.Index, FinishReason: string(choice.FinishReason)}, nil) {
+					return
+				}
+			}
+
+			if chunk.Usage != nil {
+				usage := Usage{chunk.Usage.PromptTokens, chunk.Usage.CompletionTokens, chunk.Usage.TotalTokens}
+				if !yield(Event{Type: EventUsage, Usage: usage}, nil) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// Send a streaming request and write the content of the first choice to the provided writer in chunks as they arrive.
+// It cannot be canceled; a [Runner] sends documents with a context and any [Provider].
+func Send(client *openai.Client, model ModelName, history OpenAiHistory, writer io.StringWriter, params RequestParams) error {
+	return send(context.Background(), OpenAIProvider{client}, model, history, writer, params)
+}
+
+func send(ctx context.Context, provider Provider, model ModelName, history OpenAiHistory, writer io.StringWriter, params RequestParams) error {
+	for event, err := range provider.Stream(ctx, model, history, params) {
+		if err != nil {
+			return err
+		}
+
+		if event.Type == EventDelta && event.Choice == 0 {
+			if _, err = writer.WriteString(event.Content); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// NewParameters returns parameters with the seed and the temperature, skipping those that are not set.
+// [RequestParams.Override] sets the others as well.
+func NewParameters(seed *int, temperature *float32) RequestParams {
+	return RequestParams{}.Override(seed, temperature, nil, nil)
+}
+
+// inherit fills the parameters left unset, with their zero values, from the parameters of a parent chatfile.
+func (p RequestParams) inherit(parent RequestParams) RequestParams {
+	if p.Seed == nil {
+		p.Seed = parent.Seed
+	}
+	if p.Temperature == 0 {
+		p.Temperature = parent.Temperature
+	}
+	if p.MaxTokens == 0 {
+		p.MaxTokens = parent.MaxTokens
+	}
+	if p.N == 0 {
+		p.N = parent.N
+	}
+	if p.ReasoningEffort == "" {
+		p.ReasoningEffort = parent.ReasoningEffort
+	}
+	if p.MaxCompletionTokens == 0 {
+		p.MaxCompletionTokens = parent.MaxCompletionTokens
+	}
+	return p
+}
+
+// Override returns the parameters with the given ones replaced, skipping those that are not set.
+func (p RequestParams) Override(seed *int, temperature *float32, maxTokens *int, n *int) RequestParams {
 	if seed != nil {
 		p.Seed = seed
 	}
 	if temperature != nil {
 		p.Temperature = *temperature
 	}
+	if maxTokens != nil {
+		p.MaxTokens = *maxTokens
+	}
+	if n != nil {
+		p.N = *n
+	}
+
+	return p
+}
+
+const summaryPrompt = "Summarize the following conversation between a user and an assistant. " +
+	"Keep facts, decisions and open questions, and omit pleasantries."
+
+// NewSummarizer creates a [Summarizer] that asks the model to condense a conversation.
+// Requests with an empty model name are sent to defaultModel. [Runner.Summarizer] works with any [Provider].
+func NewSummarizer(ctx context.Context, client *openai.Client, defaultModel ModelName) Summarizer {
+	return newSummarizer(ctx, OpenAIProvider{client}, defaultModel)
+}
+
+func newSummarizer(ctx context.Context, provider Provider, defaultModel ModelName) Summarizer {
+	return func(model ModelName, messages []Message) (string, error) {
+		if model == "" {
+			model = defaultModel
+		}
+
+		var transcript strings.Builder
+		for _, message := range messages {
+			_, _ = fmt.Fprintf(&transcript, "%s: %s\n\n", message.Role, message.Content)
+		}
 
-	return
+		history := OpenAiHistory{[]Message{{Role: RoleSystem, Content: summaryPrompt}, {Role: RoleUser, Content: transcript.String()}}}
+
+		var summary strings.Builder
+		err := send(ctx, provider, model, history, &summary, RequestParams{})
+		return strings.TrimSpace(summary.String()), err
+	}
+}
+
+const judgePrompt = "You grade replies of another assistant. Decide whether the reply satisfies the criteria. " +
+	"Answer with PASS or FAIL on the first line, followed by a one sentence reason."
+
+// NewJudge creates a [Judge] that asks the model to grade replies. [Runner.Judge] works with any [Provider].
+func NewJudge(ctx context.Context, client *openai.Client, model ModelName) Judge {
+	return newJudge(ctx, OpenAIProvider{client}, model)
+}
+
+func newJudge(ctx context.Context, provider Provider, model ModelName) Judge {
+	return func(criteria string, reply string) (bool, string, error) {
+		history := OpenAiHistory{[]Message{
+			{Role: RoleSystem, Content: judgePrompt},
+			{Role: RoleUser, Content: "Criteria:\n" + criteria + "\n\nReply:\n" + reply},
+		}}
+
+		var verdict strings.Builder
+		if err := send(ctx, provider, model, history, &verdict, RequestParams{}); err != nil {
+			return false, "", err
+		}
+
+		decision, reason, _ := strings.Cut(strings.TrimSpace(verdict.String()), "\n")
+		decision = strings.ToUpper(strings.Trim(decision, " *.:"))
+		passed := strings.HasPrefix(decision, "PASS")
+		if reason = strings.TrimSpace(reason); reason == "" {
+			reason = decision
+		}
+		return passed, reason, nil
+	}
 }
@@ -0,0 +1,209 @@
+package chatfile
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// LoadOptions adjust a chatfile as it is loaded by [Load].
+type LoadOptions struct {
+	// Branch selects the branch of the conversation started at the label, instead of the one written last.
+	Branch string
+
+	// Vars are substituted for ${NAME} in prompts and take precedence over VAR.
+	Vars map[string]string
+
+	// Arguments are bound to the variables declared with VAR, see [Context.Arguments].
+	// The remaining ones are joined into a question appended to the conversation.
+	Arguments []string
+
+	// Attachment is added to the last question, or as a new one, after the arguments.
+	Attachment string
+
+	// Messages are appended after the conversation of the chatfile.
+	Messages []Message
+
+	// Model replaces the one selected by FROM when not empty, as if it was the last FROM command.
+	Model ModelName
+
+	// Shell lists the programs TEMPLATE go prompts may run with the shell function.
+	Shell []string
+
+	// Env lists the environment variables TEMPLATE go prompts may read as .Env.
+	Env []string
+
+	// Paths lists directories besides the one of the chatfile that readFile and include may read from.
+	Paths []string
+
+	// Context cancels the calls of command plugins, which are bounded by [PluginTimeout] as well.
+	// Nil means [context.Background].
+	Context context.Context
+
+	// ModelFiles map model names to chatfiles. When such a model is selected,
+	// the conversation of its chatfile is prepended and its own model is selected instead.
+	// Its parameters and truncate policy apply unless the chatfile sets them, and its expectations are checked too.
+	ModelFiles map[string]string
+}
+
+// Document is a chatfile resolved for sending: its commands are applied, the branch is selected
+// and the models loaded from other chatfiles are substituted.
+type Document struct {
+	// Path is the file the document was loaded from, empty for documents read by [LoadReader].
+	Path string
+
+	Model   ModelName
+	Params  RequestParams
+	History *OpenAiHistory
+
+	// Includes are the chatfiles substituted for models, in the order they were loaded.
+	Includes []string
+
+	// Context is the state the commands were applied to, with expectations, variables and the truncate policy.
+	Context *Context
+}
+
+// Messages returns the conversation to send.
+func (d *Document) Messages() []Message {
+	return d.History.Messages()
+}
+
+// Load reads and resolves a chatfile.
+func Load(path string, options LoadOptions) (*Document, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+
+	document, err := loadReader(file, filepath.Dir(path), options)
+	if document != nil {
+		document.Path = path
+	}
+	return document, err
+}
+
+// LoadReader resolves a chatfile read from a reader.
+// The model files of the options are still read from the file system.
+// Paths in templates are relative to the working directory.
+func LoadReader(reader io.Reader, options LoadOptions) (*Document, error) {
+	return loadReader(reader, "", options)
+}
+
+func loadReader(reader io.Reader, dir string, options LoadOptions) (*Document, error) {
+	history := &OpenAiHistory{}
+	context := newContext(history, dir, options)
+	context.Variables, context.Arguments = make(map[string]string), options.Arguments
+	maps.Copy(context.Variables, options.Vars)
+
+	if err := applyChatfile(reader, context, options.Branch); err != nil {
+		return nil, err
+	}
+
+	if len(context.Arguments) > 0 {
+		history.Append(RoleUser, strings.Join(context.Arguments, " "))
+	}
+
+	if options.Attachment != "" {
+		history.Attach(options.Attachment)
+	}
+
+	for _, message := range options.Messages {
+		history.AppendMessage(message)
+	}
+
+	if options.Model != "" {
+		(&FromCommand{ModelName: string(options.Model)}).Apply(context)
+	}
+
+	document := &Document{History: history, Context: context}
+	err := document.substituteModelFiles(options)
+
+	document.Model, document.Params = context.CurrentModel, context.Parameters
+	return document, err
+}
+
+// applyChatfile applies every command of a chatfile to the context and selects the branch.
+// The syntax of the commands is kept while they are applied, so errors of templates point to the chatfile.
+func applyChatfile(reader io.Reader, context *Context, branch string) error {
+	source, err := io.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+
+	tree, err := ParseSyntax(source)
+	if err != nil {
+		return err
+	}
+
+	for i := range tree.Nodes {
+		if node := &tree.Nodes[i]; node.Command != nil {
+			context.source = node
+			node.Command.Apply(context)
+		}
+	}
+	context.source = nil
+
+	return context.Flatten(branch)
+}
+
+// newContext starts a context for the chatfile of a directory, with the templates and plugins set up by the options.
+func newContext(history ChatHistory, dir string, options LoadOptions) *Context {
+	return &Context{History: history, Dir: dir, Shell: options.Shell, Env: options.Env, Paths: options.Paths, calls: options.Context}
+}
+
+// inherit takes the model of a chatfile substituted for the model of the context, and the settings the context leaves unset:
+// parameters, unless they are set again, the truncate policy, unless there is one, and the expectations, checked first.
+func (ctx *Context) inherit(parent *Context) {
+	ctx.CurrentModel = parent.CurrentModel
+	ctx.Parameters = ctx.Parameters.inherit(parent.Parameters)
+	if ctx.Truncate == nil {
+		ctx.Truncate = parent.Truncate
+	}
+	ctx.Expectations = append(slices.Clip(parent.Expectations), ctx.Expectations...)
+}
+
+func (d *Document) substituteModelFiles(options LoadOptions) error {
+	processedModels := make(map[string]bool)
+
+	for {
+		currentModel := string(d.Context.CurrentModel)
+
+		modelFilePath, found := options.ModelFiles[currentModel]
+		if !found {
+			return nil
+		}
+
+		if processedModels[currentModel] {
+			return fmt.Errorf("circular reference detected in model '%s'", currentModel)
+		}
+
+		processedModels[currentModel] = true
+
+		modelFile, err := os.Open(modelFilePath)
+		if err != nil {
+			return err
+		}
+
+		parentHistory := OpenAiHistory{}
+		parentContext := newContext(&parentHistory, filepath.Dir(modelFilePath), options)
+		err = applyChatfile(modelFile, parentContext, "")
+		err = errors.Join(err, modelFile.Close())
+
+		if err != nil {
+			return fmt.Errorf("model file %s: %w", modelFilePath, err)
+		}
+
+		d.History.PrependHistory(parentHistory)
+		d.Context.inherit(parentContext)
+		d.Includes = append(d.Includes, modelFilePath)
+	}
+}
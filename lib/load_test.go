@@ -0,0 +1,141 @@
+package chatfile
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/vorotynsky/chatfile/test"
+)
+
+func writeChatfile(t *testing.T, dir string, name string, content string) string {
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	base := writeChatfile(t, dir, "base.chatfile", "FROM gpt-4.1\nSYSTEM Be brief.\n")
+	path := writeChatfile(t, dir, "main.chatfile", "FROM assistant\nPARAMETER temperature 0.5\nVAR name friend\nASK Hi, ${name}!\n")
+
+	document, err := Load(path, LoadOptions{
+		Arguments:  []string{"Alice", "How", "are", "you?"},
+		Messages:   []Message{{Role: RoleAssistant, Content: "Fine."}},
+		ModelFiles: map[string]string{"assistant": base},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if document.Path != path || document.Model != "gpt-4.1" || document.Params.Temperature != 0.5 {
+		t.Errorf("unexpected document %+v", document)
+	}
+	if expected := []string{base}; !slices.Equal(document.Includes, expected) {
+		t.Errorf("includes %v, expected %v", document.Includes, expected)
+	}
+	if expected := []string{"Be brief.", "Hi, Alice!", "How are you?", "Fine."}; !slices.Equal(contents(document.Messages()), expected) {
+		t.Errorf("messages %v, expected %v", contents(document.Messages()), expected)
+	}
+}
+
+// TestLoadModelFiles loads the chatfile of every case with a "loaded" validation file.
+// The other .chatfile files of the case are model files named after them.
+func TestLoadModelFiles(t *testing.T) {
+	test.DoTest(t, "loaded", func(t *testing.T, input io.Reader, output io.Writer) {
+		dir := filepath.Dir(input.(interface{ Name() string }).Name())
+		paths, _ := filepath.Glob(filepath.Join(dir, "*.chatfile"))
+
+		modelFiles := make(map[string]string)
+		for _, path := range paths {
+			modelFiles[strings.TrimSuffix(filepath.Base(path), ".chatfile")] = path
+		}
+
+		document, err := LoadReader(input, LoadOptions{ModelFiles: modelFiles})
+		if err != nil {
+			_, _ = fmt.Fprintf(output, "%v\n", err)
+			return
+		}
+
+		params, _ := json.Marshal(document.Params)
+		_, _ = fmt.Fprintf(output, "model: %s\nparams: %s\n", document.Model, params)
+		if document.Context.Truncate != nil {
+			policy, _ := formatTruncatePolicy(document.Context.Truncate)
+			_, _ = fmt.Fprintf(output, "truncate: %s\n", policy)
+		}
+		for _, expectation := range document.Context.Expectations {
+			_, _ = fmt.Fprintf(output, "expect: %s\n", expectation)
+		}
+		for _, message := range document.Messages() {
+			_, _ = fmt.Fprintf(output, "%s: %s\n", message.Role, message.Content)
+		}
+	})
+}
+
+func TestLoadCircularModelFiles(t *testing.T) {
+	dir := t.TempDir()
+	first := writeChatfile(t, dir, "first.chatfile", "FROM second\n")
+	second := writeChatfile(t, dir, "second.chatfile", "FROM first\n")
+
+	_, err := LoadReader(strings.NewReader("FROM first\nASK Hi\n"), LoadOptions{
+		ModelFiles: map[string]string{"first": first, "second": second},
+	})
+	if err == nil || !strings.Contains(err.Error(), "circular reference") {
+		t.Errorf("expected a circular reference, got %v", err)
+	}
+}
+
+func TestLoadContinuation(t *testing.T) {
+	source := "ASK Explain microservices.\nANSWER Overview.\nLABEL overview\nASK An example?\nANSWER Example.\nCONTINUE FROM overview\nLABEL costs\nASK Costs?\n"
+
+	document, err := LoadReader(strings.NewReader(source), LoadOptions{Branch: "costs"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if command, err := document.Context.Continuation(); command != nil || err != nil {
+		t.Errorf("the branch written last continued with %v, %v", command, err)
+	}
+
+	document, err = LoadReader(strings.NewReader(source), LoadOptions{Branch: "overview"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = document.Context.Continuation(); !errors.Is(err, ErrUnlabeledTip) {
+		t.Errorf("expected %v, got %v", ErrUnlabeledTip, err)
+	}
+
+	source = strings.Replace(source, "ANSWER Example.\n", "ANSWER Example.\nLABEL example\n", 1)
+	document, err = LoadReader(strings.NewReader(source), LoadOptions{Branch: "overview"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	command, err := document.Context.Continuation()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var appended strings.Builder
+	encoder := NewEncoder(&appended)
+	for _, command := range []Command{command, &PromptCommand{Role: RoleUser, Message: "Another one?"}} {
+		if err = encoder.Encode(command); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	document, err = LoadReader(strings.NewReader(source+appended.String()), LoadOptions{Branch: "overview"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"Explain microservices.", "Overview.", "An example?", "Example.", "Another one?"}
+	if !slices.Equal(contents(document.Messages()), expected) {
+		t.Errorf("messages %v, expected %v", contents(document.Messages()), expected)
+	}
+}
@@ -4,10 +4,15 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"strconv"
+	"strings"
 )
 
 var (
 	ErrExpectedCommandToken = errors.New("parser: expected command token")
+	ErrInvalidChoice        = errors.New("parser: choice must be a positive number")
+	ErrExpectedContinueFrom = errors.New("parser: expected CONTINUE FROM label")
+	ErrUnexpectedAttributes = errors.New("parser: command takes no attributes")
 )
 
 // ParseCommand parses a single command from the provided lexer.
@@ -27,7 +32,28 @@ func ParseCommand(lexer Lexer) (command Command, err error) {
 		return parseFrom(lexer)
 	case ASK, ANSWER, SYSTEM:
 		return parsePrompt(lexer)
-	default:
+	case THOUGHT:
+		return parseThought(lexer)
+	case TRUNCATE:
+		return parseTruncate(lexer)
+	case EXPECT:
+		return parseExpect(lexer)
+	case PARAMETER:
+		return parseParameter(lexer)
+	case CHOICE:
+		return parseChoice(lexer)
+	case LABEL:
+		return parseLabel(lexer)
+	case CONTINUE:
+		return parseContinue(lexer)
+	case VAR:
+		return parseVar(lexer)
+	case TEMPLATE:
+		return parseTemplate(lexer)
+	}
+
+	command, registered, err := parseRegistered(lexer)
+	if !registered {
 		err = errOr(lexer.Err(), ErrExpectedCommandToken)
 	}
 	return
@@ -106,11 +132,39 @@ func assert(lexer Lexer, expected TokenType) {
 	}
 }
 
+// moveToArgument advances to the first argument of a command, reading the attributes written before it.
+func moveToArgument(lexer Lexer, command TokenType) (Attributes, error) {
+	if !lexer.MoveNext() {
+		return nil, errOr(lexer.Err(), cmdFail(command))
+	}
+
+	if lexer.Current().Type != ATTRS {
+		return nil, nil
+	}
+	attributes := ParseAttributes(lexer.Current().Content)
+
+	if !lexer.MoveNext() {
+		return nil, errOr(lexer.Err(), cmdFail(command))
+	}
+	return attributes, nil
+}
+
+// moveToPlainArgument advances to the first argument of a command that takes no attributes.
+func moveToPlainArgument(lexer Lexer, command TokenType) error {
+	if !lexer.MoveNext() {
+		return errOr(lexer.Err(), cmdFail(command))
+	}
+	if lexer.Current().Type == ATTRS {
+		return fmt.Errorf("%w: %s", ErrUnexpectedAttributes, command)
+	}
+	return nil
+}
+
 func parseFrom(lexer Lexer) (*FromCommand, error) {
 	assert(lexer, FROM)
 
-	if !lexer.MoveNext() {
-		return nil, errOr(lexer.Err(), cmdFail(FROM))
+	if err := moveToPlainArgument(lexer, FROM); err != nil {
+		return nil, err
 	}
 
 	assert(lexer, MODEL)
@@ -133,11 +187,181 @@ func parsePrompt(lexer Lexer) (*PromptCommand, error) {
 		panic("invalid parsing state")
 	}
 
+	attributes, err := moveToArgument(lexer, startingToken.Type)
+	if err != nil {
+		return nil, err
+	}
+
+	assert(lexer, PROMPT)
+
+	return &PromptCommand{role, lexer.Current().Content, attributes}, nil
+}
+
+func parseTruncate(lexer Lexer) (*TruncateCommand, error) {
+	assert(lexer, TRUNCATE)
+
+	if err := moveToPlainArgument(lexer, TRUNCATE); err != nil {
+		return nil, err
+	}
+
+	assert(lexer, LINE)
+
+	policy, err := ParseTruncatePolicy(lexer.Current().Content)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TruncateCommand{policy}, nil
+}
+
+func parseExpect(lexer Lexer) (*ExpectCommand, error) {
+	assert(lexer, EXPECT)
+
+	if err := moveToPlainArgument(lexer, EXPECT); err != nil {
+		return nil, err
+	}
+
+	assert(lexer, WORD)
+	kind := lexer.Current().Content
+
 	if !lexer.MoveNext() {
-		return nil, errOr(lexer.Err(), cmdFail(startingToken.Type))
+		return nil, errOr(lexer.Err(), cmdFail(EXPECT))
 	}
 
 	assert(lexer, PROMPT)
 
-	return &PromptCommand{role, lexer.Current().Content}, nil
+	expectation, err := NewExpectation(kind, lexer.Current().Content)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ExpectCommand{expectation}, nil
+}
+
+func parseParameter(lexer Lexer) (*ParameterCommand, error) {
+	assert(lexer, PARAMETER)
+
+	if err := moveToPlainArgument(lexer, PARAMETER); err != nil {
+		return nil, err
+	}
+
+	assert(lexer, WORD)
+	name := lexer.Current().Content
+
+	if !lexer.MoveNext() {
+		return nil, errOr(lexer.Err(), cmdFail(PARAMETER))
+	}
+
+	assert(lexer, LINE)
+	value := lexer.Current().Content
+
+	if err := (&RequestParams{}).Set(name, value); err != nil {
+		return nil, err
+	}
+
+	return &ParameterCommand{strings.ToLower(name), value}, nil
+}
+
+func parseThought(lexer Lexer) (*ThoughtCommand, error) {
+	assert(lexer, THOUGHT)
+
+	attributes, err := moveToArgument(lexer, THOUGHT)
+	if err != nil {
+		return nil, err
+	}
+
+	assert(lexer, PROMPT)
+
+	return &ThoughtCommand{lexer.Current().Content, attributes}, nil
+}
+
+func parseChoice(lexer Lexer) (*ChoiceCommand, error) {
+	assert(lexer, CHOICE)
+
+	if err := moveToPlainArgument(lexer, CHOICE); err != nil {
+		return nil, err
+	}
+
+	assert(lexer, WORD)
+
+	index, err := strconv.Atoi(lexer.Current().Content)
+	if err != nil || index < 1 {
+		return nil, ErrInvalidChoice
+	}
+
+	return &ChoiceCommand{index}, nil
+}
+
+func parseLabel(lexer Lexer) (*LabelCommand, error) {
+	assert(lexer, LABEL)
+
+	if err := moveToPlainArgument(lexer, LABEL); err != nil {
+		return nil, err
+	}
+
+	assert(lexer, WORD)
+
+	return &LabelCommand{lexer.Current().Content}, nil
+}
+
+func parseContinue(lexer Lexer) (*ContinueCommand, error) {
+	assert(lexer, CONTINUE)
+
+	if err := moveToPlainArgument(lexer, CONTINUE); err != nil {
+		return nil, err
+	}
+
+	assert(lexer, WORD)
+
+	if strings.ToUpper(lexer.Current().Content) != string(FROM) {
+		return nil, ErrExpectedContinueFrom
+	}
+
+	if !lexer.MoveNext() {
+		return nil, errOr(lexer.Err(), cmdFail(CONTINUE))
+	}
+
+	assert(lexer, WORD)
+
+	return &ContinueCommand{lexer.Current().Content}, nil
+}
+
+func parseVar(lexer Lexer) (*VarCommand, error) {
+	assert(lexer, VAR)
+
+	if err := moveToPlainArgument(lexer, VAR); err != nil {
+		return nil, err
+	}
+
+	assert(lexer, WORD)
+	name := lexer.Current().Content
+
+	if !variableName.MatchString(name) {
+		return nil, ErrInvalidVariableName
+	}
+
+	if !lexer.MoveNext() {
+		return nil, errOr(lexer.Err(), cmdFail(VAR))
+	}
+
+	assert(lexer, LINE)
+
+	return &VarCommand{name, lexer.Current().Content}, nil
+}
+
+func parseTemplate(lexer Lexer) (*TemplateCommand, error) {
+	assert(lexer, TEMPLATE)
+
+	if err := moveToPlainArgument(lexer, TEMPLATE); err != nil {
+		return nil, err
+	}
+
+	assert(lexer, WORD)
+
+	engine := strings.ToLower(lexer.Current().Content)
+	if engine != TemplateGo && engine != TemplateNone {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownTemplate, lexer.Current().Content)
+	}
+
+	return &TemplateCommand{engine}, nil
 }
@@ -0,0 +1,242 @@
+package chatfile
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Plugins are executables found on PATH by their name: CommandPluginPrefix followed by the lowercase keyword
+// of a command they handle, or HookPluginPrefix followed by the name of a hook.
+const (
+	CommandPluginPrefix = "chatfile-cmd-"
+	HookPluginPrefix    = "chatfile-hook-"
+)
+
+var ErrPluginFailed = errors.New("plugin: call failed")
+
+// PluginTimeout bounds every call of a plugin, which is killed once it is exceeded.
+var PluginTimeout = 30 * time.Second
+
+var pluginsEnabled atomic.Bool
+
+// UsePlugins makes the lexer and the parser accept unknown keywords handled by command plugins,
+// such as TICKET handled by chatfile-cmd-ticket. Keywords without a plugin are still errors.
+// Plugins are disabled by default, as loading a chatfile would run executables it names.
+//
+// A plugin command takes a single argument written as prompts are. When applied, the plugin receives
+// the argument and a snapshot of the context, and returns messages to append, parameters and variables to set.
+func UsePlugins() {
+	pluginsEnabled.Store(true)
+}
+
+// Plugin is an external executable speaking JSON-RPC 2.0 on stdio.
+// Every call starts the executable, writes a single request to its stdin and reads a single response from its stdout.
+// The stderr of the plugin is passed through.
+type Plugin struct {
+	Path string
+}
+
+// LookupPlugin finds the executable of a plugin on PATH.
+func LookupPlugin(prefix string, name string) (*Plugin, error) {
+	path, err := exec.LookPath(prefix + strings.ToLower(name))
+	if err != nil {
+		return nil, err
+	}
+	return &Plugin{path}, nil
+}
+
+type rpcRequest struct {
+	JSONRPC string `json:"jsonrpc"`
+	ID      int    `json:"id"`
+	Method  string `json:"method"`
+	Params  any    `json:"params"`
+}
+
+type rpcResponse struct {
+	Result json.RawMessage `json:"result"`
+	Error  *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// Call sends a request to the plugin and decodes the result of its response into result.
+// The plugin is killed when ctx is done or the call takes longer than [PluginTimeout].
+func (p *Plugin) Call(ctx context.Context, method string, params any, result any) error {
+	request, err := json.Marshal(rpcRequest{"2.0", 1, method, params})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, PluginTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, p.Path)
+	cmd.Stdin = bytes.NewReader(append(request, '\n'))
+	cmd.Stderr = os.Stderr
+	cmd.WaitDelay = time.Second
+
+	output, runErr := cmd.Output()
+	if ctx.Err() != nil {
+		return fmt.Errorf("%w: %s %s: %w", ErrPluginFailed, p.Path, method, context.Cause(ctx))
+	}
+
+	var response rpcResponse
+	if err = json.NewDecoder(bytes.NewReader(output)).Decode(&response); err != nil {
+		return fmt.Errorf("%w: %s %s: %w", ErrPluginFailed, p.Path, method, errors.Join(runErr, err))
+	}
+	if response.Error != nil {
+		return fmt.Errorf("%w: %s %s: %s (%d)", ErrPluginFailed, p.Path, method, response.Error.Message, response.Error.Code)
+	}
+	if runErr != nil {
+		return fmt.Errorf("%w: %s %s: %w", ErrPluginFailed, p.Path, method, runErr)
+	}
+
+	if result == nil || len(response.Result) == 0 {
+		return nil
+	}
+	return json.Unmarshal(response.Result, result)
+}
+
+// pluginCommandParams are the params of the command method.
+type pluginCommandParams struct {
+	Keyword    string          `json:"keyword"`
+	Content    string          `json:"content"`
+	Attributes Attributes      `json:"attributes,omitempty"`
+	Context    ContextSnapshot `json:"context"`
+}
+
+// pluginCommandResult is the result of the command method. Params are set as PARAMETER commands do.
+type pluginCommandResult struct {
+	Messages  []Message         `json:"messages"`
+	Params    map[string]string `json:"params"`
+	Variables map[string]string `json:"variables"`
+}
+
+// PluginCommand is a command handled by a plugin, see [UsePlugins].
+type PluginCommand struct {
+	Keyword    string
+	Content    string
+	Attributes Attributes
+	Plugin     *Plugin
+}
+
+func (p *Plugin) construct(keyword string) CommandConstructor {
+	return func(attributes Attributes, arguments []string) (Command, error) {
+		return &PluginCommand{keyword, arguments[0], attributes, p}, nil
+	}
+}
+
+func (c *PluginCommand) Name() CommandName {
+	return CommandName(c.Keyword)
+}
+
+func (c *PluginCommand) MarshalCommand() (string, Attributes, []string) {
+	return c.Keyword, c.Attributes, []string{c.Content}
+}
+
+// callContext is the context of the calls of command plugins, see [LoadOptions].
+func (ctx *Context) callContext() context.Context {
+	if ctx.calls == nil {
+		return context.Background()
+	}
+	return ctx.calls
+}
+
+func (c *PluginCommand) Apply(ctx *Context) {
+	var result pluginCommandResult
+	params := pluginCommandParams{c.Keyword, c.Content, c.Attributes, ctx.Snapshot()}
+	if err := c.Plugin.Call(ctx.callContext(), "command", params, &result); err != nil {
+		ctx.Fail(err)
+		return
+	}
+
+	messages, err := pluginMessages(c.Plugin, result.Messages)
+	if err != nil {
+		ctx.Fail(err)
+		return
+	}
+	for _, message := range messages {
+		ctx.appendMessage(message)
+	}
+
+	for name, value := range result.Params {
+		if err := ctx.Parameters.Set(name, value); err != nil {
+			ctx.Fail(err)
+			return
+		}
+	}
+
+	if ctx.Variables == nil && len(result.Variables) > 0 {
+		ctx.Variables = make(map[string]string)
+	}
+	for name, value := range result.Variables {
+		ctx.Variables[name] = value
+	}
+}
+
+// pluginHookParams are the params of the pre-send and post-receive methods.
+// Choices are the replies received, sent to post-receive only.
+type pluginHookParams struct {
+	Path    string          `json:"path,omitempty"`
+	Context ContextSnapshot `json:"context"`
+	Choices []string        `json:"choices,omitempty"`
+}
+
+// pluginPreSendResult replaces the messages of a document when they are not null, and sets the params.
+type pluginPreSendResult struct {
+	Messages []Message         `json:"messages"`
+	Params   map[string]string `json:"params"`
+}
+
+// pluginMessages accepts roles in any case, as plugins often use the lowercase ones of the OpenAI API.
+func pluginMessages(plugin *Plugin, messages []Message) ([]Message, error) {
+	for i, message := range messages {
+		role := Role(strings.ToUpper(string(message.Role)))
+		if role != RoleSystem && role != RoleUser && role != RoleAssistant {
+			return nil, fmt.Errorf("%w: %s returned a message with unknown role %s", ErrPluginFailed, plugin.Path, message.Role)
+		}
+		messages[i].Role = role
+	}
+	return messages, nil
+}
+
+func (d *Document) snapshot() ContextSnapshot {
+	return ContextSnapshot{d.Model, d.Params, d.Messages(), d.Context.Variables}
+}
+
+// PreSend calls the pre-send method of a hook plugin, which may replace the messages and set parameters of the document.
+func (p *Plugin) PreSend(ctx context.Context, document *Document) error {
+	var result pluginPreSendResult
+	if err := p.Call(ctx, "pre-send", pluginHookParams{Path: document.Path, Context: document.snapshot()}, &result); err != nil {
+		return err
+	}
+
+	if result.Messages != nil {
+		messages, err := pluginMessages(p, result.Messages)
+		if err != nil {
+			return err
+		}
+		document.History = &OpenAiHistory{messages}
+	}
+
+	for name, value := range result.Params {
+		if err := document.Params.Set(name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PostReceive calls the post-receive method of a hook plugin with the replies to a document.
+func (p *Plugin) PostReceive(ctx context.Context, document *Document, choices []string) error {
+	return p.Call(ctx, "post-receive", pluginHookParams{document.Path, document.snapshot(), choices}, nil)
+}
@@ -0,0 +1,154 @@
+package chatfile
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestMain runs the test binary as a plugin when it is started by one of the plugin tests,
+// which link it on PATH under the names of plugins.
+func TestMain(m *testing.M) {
+	if os.Getenv("CHATFILE_TEST_PLUGIN") != "" {
+		servePlugin()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func servePlugin() {
+	var request struct {
+		Method string `json:"method"`
+		Params struct {
+			Content string          `json:"content"`
+			Context ContextSnapshot `json:"context"`
+			Choices []string        `json:"choices"`
+		} `json:"params"`
+	}
+	_ = json.NewDecoder(os.Stdin).Decode(&request)
+	params := request.Params
+
+	var result any
+	switch {
+	case request.Method == "command" && params.Content == "slow":
+		time.Sleep(time.Minute)
+	case request.Method == "command" && params.Content == "fail":
+		_ = json.NewEncoder(os.Stdout).Encode(map[string]any{"jsonrpc": "2.0", "id": 1,
+			"error": map[string]any{"code": 1, "message": "ticket not found"}})
+		return
+	case request.Method == "command":
+		result = map[string]any{
+			"messages":  []map[string]string{{"role": "user", "content": "Ticket " + params.Content + ": the build is broken."}},
+			"params":    map[string]string{"temperature": "0.1"},
+			"variables": map[string]string{"ticket": params.Content, "seen": strings.Join(contents(params.Context.Messages), ",")},
+		}
+	case request.Method == "pre-send":
+		result = map[string]any{
+			"messages": append([]Message{{Role: "system", Content: "Be brief."}}, params.Context.Messages...),
+			"params":   map[string]string{"seed": "7"},
+		}
+	case request.Method == "post-receive":
+		_ = os.WriteFile(os.Getenv("CHATFILE_TEST_RECEIVED"), []byte(strings.Join(params.Choices, "\n")), 0o644)
+	}
+
+	_ = json.NewEncoder(os.Stdout).Encode(map[string]any{"jsonrpc": "2.0", "id": 1, "result": result})
+}
+
+// linkPlugins puts the test binary on PATH under the given names.
+func linkPlugins(t *testing.T, names ...string) string {
+	executable, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	for _, name := range names {
+		if err = os.Symlink(executable, filepath.Join(dir, name)); err != nil {
+			t.Skip("symlinks are not supported:", err)
+		}
+	}
+
+	t.Setenv("PATH", dir)
+	t.Setenv("CHATFILE_TEST_PLUGIN", "1")
+	return dir
+}
+
+func TestPluginCommand(t *testing.T) {
+	linkPlugins(t, "chatfile-cmd-ticket")
+	UsePlugins()
+
+	document, err := LoadReader(strings.NewReader("FROM gpt-4.1\nSYSTEM Triage.\nTICKET ABC-1\nASK Summarize ${ticket}.\n"), LoadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"Triage.", "Ticket ABC-1: the build is broken.", "Summarize ABC-1."}
+	if !slices.Equal(contents(document.Messages()), expected) {
+		t.Errorf("messages %v, expected %v", contents(document.Messages()), expected)
+	}
+	if document.Params.Temperature != 0.1 || document.Context.Variables["seen"] != "Triage." {
+		t.Errorf("unexpected params %+v and variables %v", document.Params, document.Context.Variables)
+	}
+
+	if _, err = LoadReader(strings.NewReader("TICKET fail\n"), LoadOptions{}); !errors.Is(err, ErrPluginFailed) {
+		t.Errorf("expected %v, got %v", ErrPluginFailed, err)
+	}
+	if _, err = LoadReader(strings.NewReader("INCIDENT ABC-1\n"), LoadOptions{}); !errors.Is(err, ErrUnknownToken) {
+		t.Errorf("expected %v, got %v", ErrUnknownToken, err)
+	}
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = LoadReader(strings.NewReader("TICKET ABC-1\n"), LoadOptions{Context: canceled}); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+
+	defer func(timeout time.Duration) { PluginTimeout = timeout }(PluginTimeout)
+	PluginTimeout = 100 * time.Millisecond
+
+	start := time.Now()
+	if _, err = LoadReader(strings.NewReader("TICKET slow\n"), LoadOptions{}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("the plugin was not killed after %v", elapsed)
+	}
+}
+
+func TestPluginHooks(t *testing.T) {
+	dir := linkPlugins(t, "chatfile-hook-audit")
+	received := filepath.Join(dir, "received")
+	t.Setenv("CHATFILE_TEST_RECEIVED", received)
+
+	hook, err := LookupPlugin(HookPluginPrefix, "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	document, err := LoadReader(strings.NewReader("FROM gpt-4.1\nASK Hello there\n"), LoadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runner := &Runner{Provider: &echoProvider{}, Hooks: []Hook{hook}}
+	var output strings.Builder
+	if err = runner.Run(context.Background(), document, &output); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := []string{"Be brief.", "Hello there"}; !slices.Equal(contents(document.Messages()), expected) {
+		t.Errorf("messages %v, expected %v", contents(document.Messages()), expected)
+	}
+	if document.Params.Seed == nil || *document.Params.Seed != 7 {
+		t.Errorf("unexpected params %+v", document.Params)
+	}
+	if content, _ := os.ReadFile(received); string(content) != "Hello there" {
+		t.Errorf("post-receive got %q", content)
+	}
+}
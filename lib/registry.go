@@ -0,0 +1,140 @@
+package chatfile
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// ArgumentShape is how an argument of a registered command is written.
+type ArgumentShape int
+
+const (
+	// WordArgument is a single word.
+	WordArgument ArgumentShape = s_word
+
+	// LineArgument is the rest of the line, without surrounding whitespace.
+	LineArgument ArgumentShape = s_line
+
+	// BlockArgument is written as prompts are: the rest of the line, a | or > block, or a heredoc.
+	// It reads the rest of the command, so only the last argument can be a block.
+	BlockArgument ArgumentShape = s_prompt
+)
+
+// CommandConstructor builds a registered command from its attributes and arguments,
+// in the order of the shapes it was registered with. Errors are reported as parse errors.
+type CommandConstructor func(attributes Attributes, arguments []string) (Command, error)
+
+var (
+	ErrInvalidRegistration = errors.New("registry: invalid command registration")
+	ErrKeywordTaken        = errors.New("registry: keyword is taken")
+)
+
+var (
+	// keywordsMu guards keywords and constructors, which grow as commands are registered.
+	keywordsMu   sync.RWMutex
+	constructors = map[TokenType]CommandConstructor{}
+
+	keywordPattern = regexp.MustCompile(`^[A-Z][A-Z0-9_]*$`)
+)
+
+// RegisterCommand makes a keyword known to the lexer and the parser, so chatfiles can use directives of their own.
+// Keywords are case-insensitive, as the built-in ones are. Commands implementing [CommandMarshaler]
+// are also written by the [Encoder].
+//
+// Commands without shapes take no arguments and no attributes, as in RESET.
+// It is meant to be called from init functions, and reports [ErrKeywordTaken] when the keyword is taken
+// and [ErrInvalidRegistration] when the keyword or the shapes are invalid, such as a block that is not the last of them.
+func RegisterCommand(name string, shapes []ArgumentShape, constructor CommandConstructor) error {
+	name = strings.ToUpper(name)
+	if !keywordPattern.MatchString(name) {
+		return fmt.Errorf("%w: invalid keyword %q", ErrInvalidRegistration, name)
+	}
+	if constructor == nil {
+		return fmt.Errorf("%w: constructor of %s is nil", ErrInvalidRegistration, name)
+	}
+
+	args := make([]int, len(shapes))
+	for i, shape := range shapes {
+		if shape != WordArgument && shape != LineArgument && shape != BlockArgument {
+			return fmt.Errorf("%w: unknown argument shape %d of %s", ErrInvalidRegistration, shape, name)
+		}
+		if (shape == BlockArgument || shape == LineArgument) && i != len(shapes)-1 {
+			return fmt.Errorf("%w: only the last argument of %s can be a line or a block", ErrInvalidRegistration, name)
+		}
+		args[i] = int(shape)
+	}
+
+	if !register(name, args, constructor) {
+		return fmt.Errorf("%w: %s", ErrKeywordTaken, name)
+	}
+	return nil
+}
+
+// register adds a keyword unless it is taken.
+func register(name string, args []int, constructor CommandConstructor) bool {
+	keywordsMu.Lock()
+	defer keywordsMu.Unlock()
+
+	if _, found := keywords[name]; found {
+		return false
+	}
+	keywords[name] = keyword{TokenType(name), args}
+	constructors[TokenType(name)] = constructor
+	return true
+}
+
+// lookupKeyword finds a built-in or registered keyword, or registers the plugin handling it, see [UsePlugins].
+func lookupKeyword(name string) (keyword, bool) {
+	keywordsMu.RLock()
+	kw, found := keywords[name]
+	keywordsMu.RUnlock()
+
+	if !found && pluginsEnabled.Load() && keywordPattern.MatchString(name) {
+		if plugin, err := LookupPlugin(CommandPluginPrefix, name); err == nil {
+			register(name, []int{s_prompt}, plugin.construct(name))
+			return lookupKeyword(name)
+		}
+	}
+	return kw, found
+}
+
+// parseRegistered reads the arguments of a registered command and passes them to its constructor.
+// It returns false for tokens of unregistered commands.
+func parseRegistered(lexer Lexer) (Command, bool, error) {
+	token := lexer.Current().Type
+
+	keywordsMu.RLock()
+	kw, construct := keywords[string(token)], constructors[token]
+	keywordsMu.RUnlock()
+
+	if construct == nil {
+		return nil, false, nil
+	}
+
+	command, err := parseArguments(lexer, kw, construct)
+	return command, true, err
+}
+
+func parseArguments(lexer Lexer, kw keyword, construct CommandConstructor) (Command, error) {
+	if len(kw.args) == 0 {
+		return construct(nil, nil)
+	}
+
+	attributes, err := moveToArgument(lexer, kw.token)
+	if err != nil {
+		return nil, err
+	}
+
+	arguments := make([]string, 0, len(kw.args))
+	for i := range kw.args {
+		if i > 0 && !lexer.MoveNext() {
+			return nil, errOr(lexer.Err(), cmdFail(kw.token))
+		}
+		arguments = append(arguments, lexer.Current().Content)
+	}
+
+	return construct(attributes, arguments)
+}
@@ -0,0 +1,146 @@
+package chatfile
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// toolCommand is a team-specific directive declaring a tool with its description.
+type toolCommand struct {
+	Tool        string
+	Description string
+	Attributes  Attributes
+}
+
+func (c *toolCommand) Name() CommandName {
+	return "TOOL"
+}
+
+func (c *toolCommand) Apply(ctx *Context) {
+	ctx.Variables["tool_"+c.Tool] = c.Description
+}
+
+func (c *toolCommand) MarshalCommand() (string, Attributes, []string) {
+	return "TOOL", c.Attributes, []string{c.Tool, c.Description}
+}
+
+var errEmptyTool = errors.New("tool: empty description")
+
+// resetCommand is a directive without arguments forgetting the conversation so far.
+type resetCommand struct{}
+
+func (c *resetCommand) Name() CommandName {
+	return "RESET"
+}
+
+func (c *resetCommand) Apply(ctx *Context) {
+	ctx.History = &OpenAiHistory{}
+}
+
+func (c *resetCommand) MarshalCommand() (string, Attributes, []string) {
+	return "RESET", nil, nil
+}
+
+func init() {
+	err := RegisterCommand("tool", []ArgumentShape{WordArgument, BlockArgument}, func(attributes Attributes, arguments []string) (Command, error) {
+		if strings.TrimSpace(arguments[1]) == "" {
+			return nil, errEmptyTool
+		}
+		return &toolCommand{arguments[0], arguments[1], attributes}, nil
+	})
+	if err == nil {
+		err = RegisterCommand("reset", nil, func(Attributes, []string) (Command, error) {
+			return &resetCommand{}, nil
+		})
+	}
+	if err != nil {
+		panic(err)
+	}
+}
+
+func parseAll(source string) ([]Command, error) {
+	scanner := NewParseScanner(NewLexer(bufio.NewReader(strings.NewReader(source))))
+
+	var commands []Command
+	for scanner.Scan() {
+		commands = append(commands, scanner.Command())
+	}
+	return commands, scanner.Err()
+}
+
+func TestRegisteredCommand(t *testing.T) {
+	commands, err := parseAll("FROM gpt-4.1\nTool [internal] search |\n    Searches the wiki.\n    Returns links.\nASK Hi\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := &toolCommand{"search", "Searches the wiki.\nReturns links.", Attributes{"internal": ""}}
+	if len(commands) != 3 || !reflect.DeepEqual(commands[1], expected) {
+		t.Fatalf("unexpected commands %v", commands)
+	}
+
+	var encoded bytes.Buffer
+	if err = NewEncoder(&encoded).Encode(expected); err != nil {
+		t.Fatal(err)
+	}
+	if reparsed, err := parseAll(encoded.String()); err != nil || !reflect.DeepEqual(reparsed, []Command{expected}) {
+		t.Errorf("encoded %q parsed as %v, %v", encoded.String(), reparsed, err)
+	}
+
+	if _, err = parseAll("TOOL search <<EOF\n\nEOF\n"); !errors.Is(err, errEmptyTool) {
+		t.Errorf("expected %v, got %v", errEmptyTool, err)
+	}
+	if _, err = parseAll("TOOL search\n"); err == nil {
+		t.Error("expected an error for a missing argument")
+	}
+	if _, err = parseAll("WIDGET search\n"); !errors.Is(err, ErrUnknownToken) {
+		t.Errorf("expected %v, got %v", ErrUnknownToken, err)
+	}
+}
+
+func TestRegisteredCommandWithoutArguments(t *testing.T) {
+	commands, err := parseAll("ASK Hi\nRESET\nASK Hello\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(commands) != 3 || !reflect.DeepEqual(commands[1], &resetCommand{}) {
+		t.Fatalf("unexpected commands %v", commands)
+	}
+
+	var encoded bytes.Buffer
+	if err = NewEncoder(&encoded).Encode(&resetCommand{}); err != nil || encoded.String() != "RESET\n" {
+		t.Errorf("encoded %q, %v", encoded.String(), err)
+	}
+
+	for _, source := range []string{"RESET now\n", "RESET [hard] now\n"} {
+		if _, err = parseAll(source); err == nil {
+			t.Errorf("%q: expected an error for arguments of RESET", source)
+		}
+	}
+}
+
+func TestRegisterCommandErrors(t *testing.T) {
+	constructor := func(Attributes, []string) (Command, error) { return nil, nil }
+	registrations := map[string]struct {
+		name   string
+		shapes []ArgumentShape
+		err    error
+	}{
+		"taken":         {"ask", []ArgumentShape{BlockArgument}, ErrKeywordTaken},
+		"inner block":   {"NOTE", []ArgumentShape{BlockArgument, WordArgument}, ErrInvalidRegistration},
+		"unknown shape": {"NOTE", []ArgumentShape{ArgumentShape(100)}, ErrInvalidRegistration},
+		"invalid name":  {"two words", []ArgumentShape{WordArgument}, ErrInvalidRegistration},
+	}
+
+	for name, registration := range registrations {
+		t.Run(name, func(t *testing.T) {
+			if err := RegisterCommand(registration.name, registration.shapes, constructor); !errors.Is(err, registration.err) {
+				t.Errorf("expected %v, got %v", registration.err, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package chatfile
+
+import (
+	"context"
+	"io"
+	"iter"
+	"strings"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// Provider sends requests to a model service and streams the replies.
+// [OpenAIProvider] talks to OpenAI compatible APIs, other services are plugged in by implementing it.
+type Provider interface {
+	Stream(ctx context.Context, model ModelName, history OpenAiHistory, params RequestParams) iter.Seq2[Event, error]
+}
+
+// OpenAIConfig holds the credentials and the endpoint of an OpenAI compatible API.
+// Empty BaseURL and Project keep the defaults of the client.
+type OpenAIConfig struct {
+	APIKey  string
+	BaseURL string
+	Project string
+}
+
+// OpenAIProvider sends requests with an OpenAI client.
+type OpenAIProvider struct {
+	Client *openai.Client
+}
+
+func NewOpenAIProvider(config OpenAIConfig) OpenAIProvider {
+	clientConfig := openai.DefaultConfig(config.APIKey)
+
+	if config.BaseURL != "" {
+		clientConfig.BaseURL = config.BaseURL
+	}
+
+	if config.Project != "" {
+		clientConfig.OrgID = config.Project
+	}
+
+	return OpenAIProvider{openai.NewClientWithConfig(clientConfig)}
+}
+
+func (p OpenAIProvider) Stream(ctx context.Context, model ModelName, history OpenAiHistory, params RequestParams) iter.Seq2[Event, error] {
+	return Stream(ctx, p.Client, model, history, params)
+}
+
+// Hook is called around every request of a [Runner]. PreSend may change the document before it is sent,
+// PostReceive gets the replies once they are complete. [*Plugin] implements it for hook plugins.
+type Hook interface {
+	PreSend(ctx context.Context, document *Document) error
+	PostReceive(ctx context.Context, document *Document, choices []string) error
+}
+
+// Runner sends loaded documents to a provider.
+//
+// Run and Stream send the history of a document as it is. Fit truncates it to the context window first,
+// so a document is usually loaded, fitted and then run.
+type Runner struct {
+	Provider Provider
+
+	// Tokenizer counts the tokens of messages for Fit, [EstimateTokenizer] when nil.
+	Tokenizer Tokenizer
+
+	// Windows are the context windows Fit checks against. Models missing from them are not checked.
+	Windows ContextWindows
+
+	// Hooks are called in order by Stream and Run.
+	Hooks []Hook
+}
+
+// Fit truncates the history of a document with its policy when it exceeds the context window of the model,
+// and reports [ErrContextWindowExceeded] when it still does not fit.
+// It returns the indices of the dropped messages and the number of tokens of the request, including the completion.
+// The number of tokens is returned with ErrContextWindowExceeded too, so callers counting with [EstimateTokenizer]
+// may send the document anyway.
+func (r *Runner) Fit(ctx context.Context, document *Document) (dropped []int, tokens int, err error) {
+	var tokenizer Tokenizer = EstimateTokenizer{}
+	if r.Tokenizer != nil {
+		tokenizer = r.Tokenizer
+	}
+
+	fits := func(messages []Message) bool {
+		_, total := CountMessages(tokenizer, messages)
+		return r.Windows.CheckContextWindow(document.Model, total, document.Params.MaxTokens) == nil
+	}
+
+	dropped, err = document.History.Truncate(document.Context.Truncate, fits, r.Summarizer(ctx, document.Model))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	_, total := CountMessages(tokenizer, document.Messages())
+	err = r.Windows.CheckContextWindow(document.Model, total, document.Params.MaxTokens)
+	return dropped, total + document.Params.MaxTokens, err
+}
+
+// Summarizer creates a [Summarizer] sending its requests to the provider, see [NewSummarizer].
+func (r *Runner) Summarizer(ctx context.Context, defaultModel ModelName) Summarizer {
+	return newSummarizer(ctx, r.Provider, defaultModel)
+}
+
+// Judge creates a [Judge] sending its requests to the provider, see [NewJudge].
+func (r *Runner) Judge(ctx context.Context, model ModelName) Judge {
+	return newJudge(ctx, r.Provider, model)
+}
+
+// Stream sends a document and yields the events of the reply as they arrive.
+// Errors of hooks are yielded as errors of the request, before the first event or after the last one.
+func (r *Runner) Stream(ctx context.Context, document *Document) iter.Seq2[Event, error] {
+	return func(yield func(Event, error) bool) {
+		for _, hook := range r.Hooks {
+			if err := hook.PreSend(ctx, document); err != nil {
+				yield(Event{}, err)
+				return
+			}
+		}
+
+		choices := make([]strings.Builder, max(document.Params.N, 1))
+		for event, err := range r.Provider.Stream(ctx, document.Model, *document.History, document.Params) {
+			if err == nil && event.Type == EventDelta && event.Choice < len(choices) {
+				choices[event.Choice].WriteString(event.Content)
+			}
+			if !yield(event, err) || err != nil {
+				return
+			}
+		}
+
+		texts := make([]string, len(choices))
+		for i := range choices {
+			texts[i] = choices[i].String()
+		}
+
+		for _, hook := range r.Hooks {
+			if err := hook.PostReceive(ctx, document, texts); err != nil {
+				yield(Event{}, err)
+				return
+			}
+		}
+	}
+}
+
+// Run sends a document and writes the content of the first choice to w as it arrives.
+func (r *Runner) Run(ctx context.Context, document *Document, w io.Writer) error {
+	for event, err := range r.Stream(ctx, document) {
+		if err != nil {
+			return err
+		}
+
+		if event.Type == EventDelta && event.Choice == 0 {
+			if _, err = io.WriteString(w, event.Content); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
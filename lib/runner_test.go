@@ -0,0 +1,80 @@
+package chatfile
+
+import (
+	"context"
+	"errors"
+	"iter"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// echoProvider replies with the last message, one word per event.
+type echoProvider struct {
+	models []ModelName
+}
+
+func (p *echoProvider) Stream(_ context.Context, model ModelName, history OpenAiHistory, _ RequestParams) iter.Seq2[Event, error] {
+	p.models = append(p.models, model)
+	messages := history.Messages()
+
+	return func(yield func(Event, error) bool) {
+		for _, word := range strings.SplitAfter(messages[len(messages)-1].Content, " ") {
+			if !yield(Event{Type: EventDelta, Content: word}, nil) {
+				return
+			}
+		}
+		yield(Event{Type: EventFinish, FinishReason: "stop"}, nil)
+	}
+}
+
+func TestRunnerRun(t *testing.T) {
+	provider := &echoProvider{}
+	runner := &Runner{Provider: provider}
+
+	document, err := LoadReader(strings.NewReader("FROM gpt-4.1\nASK Hello there, world\n"), LoadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var output strings.Builder
+	if err = runner.Run(context.Background(), document, &output); err != nil {
+		t.Fatal(err)
+	}
+
+	if output.String() != "Hello there, world" {
+		t.Errorf("unexpected output %q", output.String())
+	}
+	if expected := []ModelName{"gpt-4.1"}; !slices.Equal(provider.models, expected) {
+		t.Errorf("models %v, expected %v", provider.models, expected)
+	}
+}
+
+func TestRunnerFit(t *testing.T) {
+	source := "FROM small\nTRUNCATE oldest\nASK one two three four\nANSWER five six seven eight\nASK nine\n"
+	document, err := LoadReader(strings.NewReader(source), LoadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runner := &Runner{Provider: &echoProvider{}, Windows: ContextWindows{"small": 20}}
+	dropped, tokens, err := runner.Fit(context.Background(), document)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := []int{0, 1}; !slices.Equal(dropped, expected) {
+		t.Errorf("dropped %v, expected %v", dropped, expected)
+	}
+	if tokens == 0 || tokens > 20 {
+		t.Errorf("unexpected token count %d", tokens)
+	}
+
+	document.Params.MaxTokens = 100
+	if _, tokens, err = runner.Fit(context.Background(), document); !errors.Is(err, ErrContextWindowExceeded) {
+		t.Errorf("expected %v, got %v", ErrContextWindowExceeded, err)
+	}
+	if tokens <= 100 {
+		t.Errorf("unexpected token count %d of a document exceeding the window", tokens)
+	}
+}
@@ -0,0 +1,214 @@
+package chatfile
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Position is a location in the source of a chatfile.
+type Position struct {
+	// Offset is the number of bytes before the position.
+	Offset int
+
+	// Line is 1-based.
+	Line int
+
+	// Column is 1-based and counted in UTF-16 code units, as editors and the Language Server Protocol do.
+	Column int
+}
+
+// Span is a range of the source, from Start up to but not including End.
+type Span struct {
+	Start Position
+	End   Position
+}
+
+// SyntaxToken is a piece of the source of a chatfile.
+// Content is the value read by the lexer, such as a prompt without its indentation,
+// while Text is the source exactly as written.
+// Whitespace between the tokens of a command is kept as TRIVIA tokens.
+type SyntaxToken struct {
+	Type    TokenType
+	Content string
+	Text    string
+	Span
+}
+
+// SyntaxNode is a command with its tokens, or trivia between commands when Command is nil:
+// blank lines, indentation and the shebang line.
+type SyntaxNode struct {
+	Command Command
+	Tokens  []SyntaxToken
+	Span
+}
+
+// Text returns the source of the node.
+func (n SyntaxNode) Text() string {
+	var text []byte
+	for _, token := range n.Tokens {
+		text = append(text, token.Text...)
+	}
+	return string(text)
+}
+
+// SyntaxTree is the concrete syntax of a chatfile.
+// Unlike the commands returned by the parser, it keeps every byte of the source, so tools can rewrite a chatfile
+// without losing its formatting, see [SyntaxTree.Encode].
+type SyntaxTree struct {
+	Nodes []SyntaxNode
+}
+
+// Commands returns the parsed commands in order.
+func (t *SyntaxTree) Commands() []Command {
+	var commands []Command
+	for _, node := range t.Nodes {
+		if node.Command != nil {
+			commands = append(commands, node.Command)
+		}
+	}
+	return commands
+}
+
+// Encode writes the source of the tree. An unchanged tree reproduces the parsed source byte for byte.
+func (t *SyntaxTree) Encode(w io.Writer) error {
+	for _, node := range t.Nodes {
+		for _, token := range node.Tokens {
+			if _, err := io.WriteString(w, token.Text); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// SyntaxError is returned by [ParseSyntax] with the token where parsing failed.
+type SyntaxError struct {
+	Err   error
+	Token Token
+	Span
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("%d:%d: %v", e.Start.Line, e.Start.Column, e.Err)
+}
+
+func (e *SyntaxError) Unwrap() error {
+	return e.Err
+}
+
+// ParseSyntax parses a chatfile into its concrete syntax tree.
+// On errors the tree holds the commands parsed before the failed one, and the error is a [*SyntaxError].
+func ParseSyntax(source []byte) (*SyntaxTree, error) {
+	lexer := &recordingLexer{
+		ReaderLexer: NewLexer(bufio.NewReader(bytes.NewReader(source))).(*ReaderLexer),
+		positions:   newPositions(source),
+		source:      source,
+	}
+	tree := &SyntaxTree{}
+
+	for {
+		lexer.command = true
+		command, err := ParseCommand(lexer)
+
+		if trivia := lexer.trivia; trivia != nil {
+			tree.Nodes = append(tree.Nodes, lexer.node(nil, []SyntaxToken{*trivia}))
+			lexer.trivia = nil
+		}
+
+		if err == io.EOF {
+			if lexer.offset < len(source) {
+				token := lexer.token(TRIVIA, "", lexer.offset, len(source))
+				tree.Nodes = append(tree.Nodes, lexer.node(nil, []SyntaxToken{token}))
+			}
+			return tree, nil
+		}
+		if err != nil {
+			start, end := lexer.Span()
+			return tree, &SyntaxError{err, lexer.Current(), Span{lexer.position(start), lexer.position(max(start, end))}}
+		}
+
+		tree.Nodes = append(tree.Nodes, lexer.node(command, lexer.tokens))
+		lexer.tokens = nil
+	}
+}
+
+// recordingLexer collects the tokens read by the parser along with the whitespace between them.
+type recordingLexer struct {
+	*ReaderLexer
+	positions []int
+	source    []byte
+
+	// offset is the end of the last recorded token.
+	offset int
+
+	// command is set until the first token of a command is read,
+	// so the whitespace before it is trivia between commands.
+	command bool
+	trivia  *SyntaxToken
+	tokens  []SyntaxToken
+}
+
+func (l *recordingLexer) MoveNext() bool {
+	if !l.ReaderLexer.MoveNext() {
+		return false
+	}
+
+	start, end := l.Span()
+	if start > l.offset {
+		trivia := l.token(TRIVIA, "", l.offset, start)
+		if l.command {
+			l.trivia = &trivia
+		} else {
+			l.tokens = append(l.tokens, trivia)
+		}
+	}
+
+	l.tokens = append(l.tokens, l.token(l.Current().Type, l.Current().Content, start, end))
+	l.offset = end
+	l.command = false
+	return true
+}
+
+func (l *recordingLexer) token(tokenType TokenType, content string, start int, end int) SyntaxToken {
+	return SyntaxToken{tokenType, content, string(l.source[start:end]), Span{l.position(start), l.position(end)}}
+}
+
+func (l *recordingLexer) node(command Command, tokens []SyntaxToken) SyntaxNode {
+	return SyntaxNode{command, tokens, Span{tokens[0].Start, tokens[len(tokens)-1].End}}
+}
+
+// newPositions returns the offsets of the beginnings of lines.
+func newPositions(source []byte) []int {
+	lines := []int{0}
+	for i, b := range source {
+		if b == '\n' {
+			lines = append(lines, i+1)
+		}
+	}
+	return lines
+}
+
+func (l *recordingLexer) position(offset int) Position {
+	line := sort.SearchInts(l.positions, offset+1) - 1
+
+	return Position{offset, line + 1, 1 + utf16Len(string(l.source[l.positions[line]:offset]))}
+}
+
+// utf16Len returns the length of a text in UTF-16 code units. Invalid bytes count as one unit each.
+func utf16Len(text string) (length int) {
+	for len(text) > 0 {
+		r, size := utf8.DecodeRuneInString(text)
+		if n := utf16.RuneLen(r); n > 0 {
+			length += n
+		} else {
+			length++
+		}
+		text = text[size:]
+	}
+	return length
+}
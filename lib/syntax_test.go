@@ -0,0 +1,79 @@
+package chatfile
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/vorotynsky/chatfile/test"
+)
+
+func TestSyntaxTree(t *testing.T) {
+	test.DoTest(t, "parsed", func(t *testing.T, input io.Reader, output io.Writer) {
+		source, _ := io.ReadAll(input)
+		tree, err := ParseSyntax(source)
+
+		for _, command := range tree.Commands() {
+			_, _ = fmt.Fprintf(output, "%s: %v\n", command.Name(), command)
+		}
+
+		var syntaxErr *SyntaxError
+		if errors.As(err, &syntaxErr) {
+			_, _ = fmt.Fprintf(output, "\n%v\n%v\n", syntaxErr.Err, syntaxErr.Token)
+			return
+		}
+
+		var encoded bytes.Buffer
+		if err := tree.Encode(&encoded); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(encoded.Bytes(), source) {
+			t.Errorf("encoded tree differs from the source:\n%q\n%q", encoded.String(), source)
+		}
+	})
+}
+
+func TestSyntaxSpans(t *testing.T) {
+	source := "#!/usr/bin/env chatfile\nFROM  gpt-4.1\n\nASK [cache] Привет, 🌍 world  \nANSWER |\n    Hi!\n\n"
+
+	tree, err := ParseSyntax([]byte(source))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var texts []string
+	for _, node := range tree.Nodes {
+		texts = append(texts, node.Text())
+	}
+	expected := []string{"#!/usr/bin/env chatfile\n", "FROM  gpt-4.1", "\n\n", "ASK [cache] Привет, 🌍 world", "  \n",
+		"ANSWER |\n    Hi!", "\n\n"}
+	if fmt.Sprintf("%q", texts) != fmt.Sprintf("%q", expected) {
+		t.Fatalf("nodes %q, expected %q", texts, expected)
+	}
+
+	ask := tree.Nodes[3]
+	prompt := ask.Tokens[len(ask.Tokens)-1]
+	if prompt.Type != PROMPT || prompt.Content != "Привет, 🌍 world" {
+		t.Fatalf("unexpected token %+v", prompt)
+	}
+	if start := (Position{Offset: 51, Line: 4, Column: 13}); prompt.Start != start {
+		t.Errorf("prompt starts at %+v, expected %+v", prompt.Start, start)
+	}
+	if end := (Position{Offset: 75, Line: 4, Column: 29}); prompt.End != end {
+		t.Errorf("prompt ends at %+v, expected %+v", prompt.End, end)
+	}
+}
+
+func TestSyntaxError(t *testing.T) {
+	_, err := ParseSyntax([]byte("FROM model\nASK\nANSWER Hi\n"))
+
+	var syntaxErr *SyntaxError
+	if !errors.As(err, &syntaxErr) || !errors.Is(err, ErrExpectedPrompt) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if syntaxErr.Start.Line != 3 || syntaxErr.Error() != "3:1: "+ErrExpectedPrompt.Error() {
+		t.Errorf("unexpected error %v", syntaxErr)
+	}
+}
@@ -0,0 +1,238 @@
+package chatfile
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+var (
+	ErrUnknownTemplate   = errors.New("parser: unknown template engine, expected go or none")
+	ErrShellNotAllowed   = errors.New("shell program is not allowed")
+	ErrPathNotAllowed    = errors.New("path is not allowed")
+	ErrIncludeNesting    = errors.New("includes are nested too deep")
+	templateErrorPattern = regexp.MustCompile(`(?s)^template: prompt:(\d+)(?::(\d+))?: (.*)$`)
+)
+
+// Template engines selected with TEMPLATE.
+const (
+	// TemplateNone expands ${name} references only, as chatfiles do by default.
+	TemplateNone = "none"
+
+	// TemplateGo renders SYSTEM and ASK prompts with text/template. Answers are kept as they are,
+	// as replies of models often hold text that looks like a template.
+	TemplateGo = "go"
+)
+
+const maxIncludeDepth = 16
+
+// TemplateCommand selects how the prompts that follow it are rendered.
+type TemplateCommand struct {
+	Engine string
+}
+
+func (c *TemplateCommand) Name() CommandName {
+	return "TEMPLATE"
+}
+
+func (c *TemplateCommand) Apply(ctx *Context) {
+	ctx.Template = c.Engine
+}
+
+// TemplateError is an error rendering a prompt, at its position in the chatfile.
+type TemplateError struct {
+	Position
+	Message string
+	Err     error
+}
+
+func (e *TemplateError) Error() string {
+	return fmt.Sprintf("%d:%d: template: %s", e.Line, e.Column, e.Message)
+}
+
+func (e *TemplateError) Unwrap() error {
+	return e.Err
+}
+
+// templateData is the dot of prompt templates.
+type templateData struct {
+	Vars  map[string]string
+	Env   map[string]string
+	Model ModelName
+}
+
+// expandPrompt renders the content of a prompt with the template engine of the context.
+func (ctx *Context) expandPrompt(role Role, text string) (string, error) {
+	if ctx.Template != TemplateGo || role == RoleAssistant {
+		return ExpandVariables(text, ctx.Variables), nil
+	}
+
+	env := make(map[string]string)
+	for _, name := range ctx.Env {
+		if value, found := os.LookupEnv(name); found {
+			env[name] = value
+		}
+	}
+
+	output, err := ctx.render("prompt", text, templateData{ctx.Variables, env, ctx.CurrentModel}, 0)
+	if err != nil {
+		return "", ctx.templateError(err)
+	}
+	return output, nil
+}
+
+func (ctx *Context) render(name string, text string, data templateData, depth int) (string, error) {
+	tmpl, err := template.New(name).Option("missingkey=error").Funcs(ctx.templateFuncs(data, depth)).Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	var output strings.Builder
+	err = tmpl.Execute(&output, data)
+	return output.String(), err
+}
+
+// resolve makes a path of a template relative to the directory of the chatfile,
+// and checks that it is in that directory or in one of the allowed ones, following symbolic links.
+func (ctx *Context) resolve(path string) (string, error) {
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(ctx.Dir, path)
+	}
+	resolved, err := realPath(path)
+	if err != nil {
+		return "", err
+	}
+
+	for _, dir := range append([]string{ctx.Dir}, ctx.Paths...) {
+		if dir, err = realPath(dir); err != nil {
+			continue
+		}
+		if relative, err := filepath.Rel(dir, resolved); err == nil && filepath.IsLocal(relative) {
+			return resolved, nil
+		}
+	}
+	return "", fmt.Errorf("%w: %s is outside the directory of the chatfile", ErrPathNotAllowed, path)
+}
+
+// realPath makes a path absolute and resolves its symbolic links. Empty means the working directory.
+func realPath(path string) (string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(path)
+}
+
+func (ctx *Context) templateFuncs(data templateData, depth int) template.FuncMap {
+	return template.FuncMap{
+		"readFile": func(path string) (string, error) {
+			path, err := ctx.resolve(path)
+			if err != nil {
+				return "", err
+			}
+			content, err := os.ReadFile(path)
+			return string(content), err
+		},
+		"include": func(path string) (string, error) {
+			if depth >= maxIncludeDepth {
+				return "", ErrIncludeNesting
+			}
+			resolved, err := ctx.resolve(path)
+			if err != nil {
+				return "", err
+			}
+			content, err := os.ReadFile(resolved)
+			if err != nil {
+				return "", err
+			}
+			return ctx.render(path, string(content), data, depth+1)
+		},
+		"json": func(value any) (string, error) {
+			encoded, err := json.Marshal(value)
+			return string(encoded), err
+		},
+		"indent": func(spaces int, text string) string {
+			lines := strings.Split(text, "\n")
+			for i, line := range lines {
+				if line != "" {
+					lines[i] = strings.Repeat(" ", spaces) + line
+				}
+			}
+			return strings.Join(lines, "\n")
+		},
+		"split": func(separator string, text string) []string {
+			return strings.Split(text, separator)
+		},
+		"now": time.Now,
+		"shell": func(program string, arguments ...string) (string, error) {
+			if !slices.Contains(ctx.Shell, program) {
+				return "", fmt.Errorf("%w: %s", ErrShellNotAllowed, program)
+			}
+			cmd := exec.Command(program, arguments...)
+			cmd.Dir = ctx.Dir
+			cmd.Stderr = os.Stderr
+			output, err := cmd.Output()
+			return strings.TrimRight(string(output), "\n"), err
+		},
+	}
+}
+
+// templateError maps the position of an error in a prompt to the chatfile, when the source of the command is known.
+func (ctx *Context) templateError(err error) error {
+	match := templateErrorPattern.FindStringSubmatch(err.Error())
+	if match == nil || ctx.source == nil {
+		return err
+	}
+
+	var prompt *SyntaxToken
+	for i := range ctx.source.Tokens {
+		if ctx.source.Tokens[i].Type == PROMPT {
+			prompt = &ctx.source.Tokens[i]
+		}
+	}
+	if prompt == nil {
+		return err
+	}
+
+	line, _ := strconv.Atoi(match[1])
+	column, _ := strconv.Atoi(match[2])
+	return &TemplateError{promptPosition(*prompt, line, column), match[3], err}
+}
+
+// promptPosition finds a position given by the line and the 0-based byte column of the content of a prompt.
+// Lines of blocks are matched to the source by their indentation. Folded blocks are matched line by line,
+// which is only approximate.
+func promptPosition(prompt SyntaxToken, line int, column int) Position {
+	raw := strings.Split(prompt.Text, "\n")
+	content := strings.Split(prompt.Content, "\n")
+
+	// A single line prompt is its own first line, block and heredoc lines follow their header.
+	index, offset := 0, 0
+	if len(raw) > 1 {
+		index = min(max(line, 1), len(raw)-1)
+		if i := index - 1; i < len(content) && strings.HasSuffix(raw[index], content[i]) {
+			offset = len(raw[index]) - len(content[i])
+		}
+	}
+
+	text := raw[index]
+	prefix := text[:min(offset+column, len(text))]
+
+	position := Position{Offset: prompt.Start.Offset + len(prefix), Line: prompt.Start.Line + index, Column: 1 + utf16Len(prefix)}
+	for _, previous := range raw[:index] {
+		position.Offset += len(previous) + 1
+	}
+	if index == 0 {
+		position.Column += prompt.Start.Column - 1
+	}
+	return position
+}
@@ -0,0 +1,100 @@
+package chatfile
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestTemplateErrorPosition(t *testing.T) {
+	sources := map[string]Position{
+		"FROM gpt-4.1\nTEMPLATE go\nASK Hi, {{.Vars.name}}!\n":                          {Offset: 40, Line: 3, Column: 16},
+		"TEMPLATE go\nASK |\n    Hello,\n      {{.Vars.name}}\n":                        {Offset: 42, Line: 4, Column: 14},
+		"TEMPLATE go\nASK <<END\nHello,\n🌍 {{.Vars.name}}\nEND\n":                       {Offset: 41, Line: 4, Column: 11},
+		"TEMPLATE go\nSYSTEM [cache] |2\n  First\n  {{if .Vars.x}}{{.Vars.y}}{{end}}\n": {Offset: 61, Line: 4, Column: 24},
+	}
+
+	for source, expected := range sources {
+		_, err := LoadReader(strings.NewReader(source), LoadOptions{Vars: map[string]string{"x": "1"}})
+
+		var templateErr *TemplateError
+		if !errors.As(err, &templateErr) {
+			t.Errorf("%q: expected a template error, got %v", source, err)
+			continue
+		}
+		if templateErr.Position != expected {
+			t.Errorf("%q: error %v at %+v, expected %+v", source, err, templateErr.Position, expected)
+		}
+	}
+}
+
+func TestTemplateFunctions(t *testing.T) {
+	dir := t.TempDir()
+	writeChatfile(t, dir, "notes.txt", "first\nsecond")
+	writeChatfile(t, dir, "part.tmpl", "Part for {{.Vars.name}}")
+	path := writeChatfile(t, dir, "main.chatfile", "TEMPLATE go\n"+
+		"ASK |\n"+
+		"    Notes:\n"+
+		"    {{readFile \"notes.txt\" | indent 2}}\n"+
+		"    {{include \"part.tmpl\"}}, {{shell \"echo\" \"from\" \"shell\"}}\n"+
+		"    {{.Env.CHATFILE_TEMPLATE_TEST}} {{now.Year | printf \"%T\"}}\n")
+	t.Setenv("CHATFILE_TEMPLATE_TEST", "env")
+
+	options := LoadOptions{Vars: map[string]string{"name": "Alice"}, Shell: []string{"echo"}, Env: []string{"CHATFILE_TEMPLATE_TEST"}}
+	document, err := Load(path, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"Notes:\n  first\n  second\nPart for Alice, from shell\nenv int"}
+	if !slices.Equal(contents(document.Messages()), expected) {
+		t.Errorf("messages %q, expected %q", contents(document.Messages()), expected)
+	}
+
+	_, err = Load(path, LoadOptions{Vars: options.Vars, Env: options.Env})
+	if !errors.Is(err, ErrShellNotAllowed) {
+		t.Errorf("expected %v, got %v", ErrShellNotAllowed, err)
+	}
+
+	// Variables of the environment that are not allowed are undefined keys.
+	var templateErr *TemplateError
+	if _, err = Load(path, LoadOptions{Vars: options.Vars, Shell: options.Shell}); !errors.As(err, &templateErr) {
+		t.Errorf("expected a template error, got %v", err)
+	}
+
+	writeChatfile(t, dir, "loop.tmpl", "{{include \"loop.tmpl\"}}")
+	loop := writeChatfile(t, dir, "loop.chatfile", "TEMPLATE go\nASK {{include \"loop.tmpl\"}}\n")
+	if _, err = Load(loop, LoadOptions{}); !errors.Is(err, ErrIncludeNesting) {
+		t.Errorf("expected %v, got %v", ErrIncludeNesting, err)
+	}
+}
+
+func TestTemplatePaths(t *testing.T) {
+	dir, outside := t.TempDir(), t.TempDir()
+	secret := writeChatfile(t, outside, "secret.txt", "secret")
+	if err := os.Symlink(secret, filepath.Join(dir, "link.txt")); err != nil {
+		t.Skip("symlinks are not supported:", err)
+	}
+
+	escapes := []string{secret, filepath.Join("..", filepath.Base(outside), "secret.txt"), "link.txt"}
+	for _, escape := range escapes {
+		for _, function := range []string{"readFile", "include"} {
+			path := writeChatfile(t, dir, "main.chatfile", fmt.Sprintf("TEMPLATE go\nASK {{%s %q}}\n", function, escape))
+
+			if _, err := Load(path, LoadOptions{}); !errors.Is(err, ErrPathNotAllowed) {
+				t.Errorf("%s %s: expected %v, got %v", function, escape, ErrPathNotAllowed, err)
+			}
+
+			document, err := Load(path, LoadOptions{Paths: []string{outside}})
+			if err != nil {
+				t.Errorf("%s %s: %v", function, escape, err)
+			} else if expected := []string{"secret"}; !slices.Equal(contents(document.Messages()), expected) {
+				t.Errorf("%s %s: messages %q, expected %q", function, escape, contents(document.Messages()), expected)
+			}
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package chatfile
+
+import (
+	"bufio"
+	"embed"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+var (
+	ErrInvalidEncoding       = errors.New("tokens: invalid BPE encoding file")
+	ErrUnknownEncoding       = errors.New("tokens: encoding is not bundled")
+	ErrInvalidContextWindows = errors.New("tokens: invalid context window table")
+	ErrContextWindowExceeded = errors.New("tokens: context window exceeded")
+)
+
+// Tokens that every message and every reply costs on top of its content.
+// The numbers follow the chat markup used by the cl100k and o200k model families.
+const (
+	tokensPerMessage = 3
+	tokensPerReply   = 3
+)
+
+// pretokenizer splits text into pieces before byte pair merging.
+// It mirrors the cl100k pattern as closely as RE2 allows: the `\s+(?!\S)` branch
+// needs a lookahead, so whitespace runs are kept whole and counts may differ slightly.
+var pretokenizer = regexp.MustCompile(`(?i:'s|'t|'re|'ve|'m|'ll|'d)|[^\r\n\p{L}\p{N}]?\p{L}+|\p{N}{1,3}| ?[^\s\p{L}\p{N}]+[\r\n]*|\s*[\r\n]+|\s+`)
+
+// Tokenizer counts the tokens a model would see for a piece of text.
+type Tokenizer interface {
+	Count(text string) int
+}
+
+// BPETokenizer is an offline byte pair encoding tokenizer.
+// It reads ranks in the tiktoken format, so cl100k_base and o200k_base files can be used as is.
+type BPETokenizer struct {
+	ranks map[string]int
+}
+
+// LoadBPE reads a tiktoken rank file, where every line is a base64 encoded token followed by its rank.
+func LoadBPE(reader io.Reader) (*BPETokenizer, error) {
+	ranks := make(map[string]int)
+
+	scanner := bufio.NewScanner(reader)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		token, rank, found := strings.Cut(text, " ")
+		if !found {
+			return nil, fmt.Errorf("%w: line %d", ErrInvalidEncoding, line)
+		}
+
+		bytes, err := base64.StdEncoding.DecodeString(token)
+		if err != nil {
+			return nil, fmt.Errorf("%w: line %d: %v", ErrInvalidEncoding, line, err)
+		}
+
+		value, err := strconv.Atoi(rank)
+		if err != nil {
+			return nil, fmt.Errorf("%w: line %d: %v", ErrInvalidEncoding, line, err)
+		}
+
+		ranks[string(bytes)] = value
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return &BPETokenizer{ranks}, nil
+}
+
+func (t *BPETokenizer) Count(text string) (count int) {
+	for _, piece := range pretokenizer.FindAllString(text, -1) {
+		if _, ok := t.ranks[piece]; ok {
+			count++
+		} else {
+			count += t.mergeCount(piece)
+		}
+	}
+	return
+}
+
+// mergeCount applies byte pair merges to a piece, always joining the lowest ranked pair first,
+// and returns the number of resulting tokens.
+func (t *BPETokenizer) mergeCount(piece string) int {
+	parts := make([]int, 0, len(piece)+1)
+	for i := 0; i <= len(piece); i++ {
+		parts = append(parts, i)
+	}
+
+	for len(parts) > 2 {
+		best, bestRank := -1, 0
+		for i := 0; i+2 < len(parts); i++ {
+			rank, ok := t.ranks[piece[parts[i]:parts[i+2]]]
+			if ok && (best < 0 || rank < bestRank) {
+				best, bestRank = i, rank
+			}
+		}
+
+		if best < 0 {
+			break
+		}
+
+		parts = append(parts[:best+1], parts[best+2:]...)
+	}
+
+	return len(parts) - 1
+}
+
+// DefaultEncodings are the bundled encodings tried by [DefaultTokenizer], in order.
+var DefaultEncodings = []string{"o200k_base", "cl100k_base"}
+
+//go:embed encodings
+var encodings embed.FS
+
+// BundledBPE loads an encoding embedded into the package, such as o200k_base.
+// Encodings are bundled by placing their tiktoken rank files in the encodings directory before building.
+func BundledBPE(name string) (*BPETokenizer, error) {
+	file, err := encodings.Open("encodings/" + name + ".tiktoken")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownEncoding, name)
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	return LoadBPE(file)
+}
+
+// DefaultTokenizer is the first bundled encoding of [DefaultEncodings],
+// or an [EstimateTokenizer] when none of them is bundled.
+func DefaultTokenizer() (Tokenizer, error) {
+	for _, name := range DefaultEncodings {
+		bpe, err := BundledBPE(name)
+		if errors.Is(err, ErrUnknownEncoding) {
+			continue
+		}
+		return bpe, err
+	}
+	return EstimateTokenizer{}, nil
+}
+
+// EstimateTokenizer approximates token counts without a vocabulary.
+// Every pre-tokenized piece costs one token per four characters, which tends to overestimate
+// English prose a little, so context checks err on the safe side.
+type EstimateTokenizer struct{}
+
+func (EstimateTokenizer) Count(text string) (count int) {
+	for _, piece := range pretokenizer.FindAllString(text, -1) {
+		count += (utf8.RuneCountInString(piece) + 3) / 4
+	}
+	return
+}
+
+// CountMessages returns the token count of every message, including the chat markup around it,
+// and the total cost of sending them as one request.
+func CountMessages(tokenizer Tokenizer, messages []Message) (counts []int, total int) {
+	counts = make([]int, len(messages))
+
+	for i, message := range messages {
+		counts[i] = tokensPerMessage + tokenizer.Count(message.Content)
+		total += counts[i]
+	}
+
+	total += tokensPerReply
+	return
+}
+
+//go:embed context_windows.txt
+var defaultContextWindows string
+
+// ContextWindows maps model name prefixes to the size of their context window in tokens.
+type ContextWindows map[string]int
+
+// DefaultContextWindows returns the built-in table of well-known models.
+func DefaultContextWindows() ContextWindows {
+	windows := make(ContextWindows)
+	if err := windows.Load(strings.NewReader(defaultContextWindows)); err != nil {
+		panic(err)
+	}
+	return windows
+}
+
+// Load reads a table where every line holds a model name prefix and a window size,
+// separated by whitespace. Empty lines and lines starting with # are skipped.
+// Entries override the ones already present.
+func (w ContextWindows) Load(reader io.Reader) error {
+	scanner := bufio.NewScanner(reader)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		if len(fields) != 2 {
+			return fmt.Errorf("%w: line %d", ErrInvalidContextWindows, line)
+		}
+
+		size, err := strconv.Atoi(fields[1])
+		if err != nil || size <= 0 {
+			return fmt.Errorf("%w: line %d", ErrInvalidContextWindows, line)
+		}
+
+		w[fields[0]] = size
+	}
+	return scanner.Err()
+}
+
+// Lookup finds the window of a model using the longest matching prefix.
+func (w ContextWindows) Lookup(model ModelName) (size int, found bool) {
+	longest := -1
+	for prefix, value := range w {
+		if strings.HasPrefix(string(model), prefix) && len(prefix) > longest {
+			longest, size, found = len(prefix), value, true
+		}
+	}
+	return
+}
+
+// CheckContextWindow reports [ErrContextWindowExceeded] when the prompt together with
+// the reserved completion tokens does not fit the model's window.
+// Models missing from the table are never reported.
+func (w ContextWindows) CheckContextWindow(model ModelName, promptTokens int, maxTokens int) error {
+	size, found := w.Lookup(model)
+	if !found || promptTokens+maxTokens <= size {
+		return nil
+	}
+
+	return fmt.Errorf("%w: %d prompt + %d completion tokens > %d for %s", ErrContextWindowExceeded, promptTokens, maxTokens, size, model)
+}
@@ -0,0 +1,96 @@
+package chatfile
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func testRanks(tokens ...string) string {
+	var builder strings.Builder
+	for rank, token := range tokens {
+		_, _ = fmt.Fprintf(&builder, "%s %d\n", base64.StdEncoding.EncodeToString([]byte(token)), rank)
+	}
+	return builder.String()
+}
+
+func TestBPETokenizer(t *testing.T) {
+	ranks := testRanks("a", "b", "c", " ", "ab", "abc", " ab")
+	tokenizer, err := LoadBPE(strings.NewReader(ranks))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]int{
+		"":        0,
+		"abc":     1,
+		"abcab":   2,
+		"abc ab":  2,
+		"cba":     3,
+		"abc abx": 3,
+	}
+
+	for text, expected := range cases {
+		if actual := tokenizer.Count(text); actual != expected {
+			t.Errorf("Count(%q) = %d, expected %d", text, actual, expected)
+		}
+	}
+}
+
+func TestLoadBPEInvalid(t *testing.T) {
+	_, err := LoadBPE(strings.NewReader("YQ== 0\nYg==\n"))
+	if !errors.Is(err, ErrInvalidEncoding) {
+		t.Errorf("expected %v, got %v", ErrInvalidEncoding, err)
+	}
+}
+
+func TestBundledBPE(t *testing.T) {
+	if _, err := BundledBPE("p50k_missing"); !errors.Is(err, ErrUnknownEncoding) {
+		t.Errorf("expected %v, got %v", ErrUnknownEncoding, err)
+	}
+
+	tokenizer, err := DefaultTokenizer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, bundled := tokenizer.(*BPETokenizer); !bundled {
+		for _, name := range DefaultEncodings {
+			if _, err = BundledBPE(name); err == nil {
+				t.Errorf("%s is bundled, but the default tokenizer is %T", name, tokenizer)
+			}
+		}
+	}
+}
+
+func TestContextWindows(t *testing.T) {
+	windows := DefaultContextWindows()
+	if err := windows.Load(strings.NewReader("# local models\nllama3 8192\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[ModelName]int{
+		"gpt-4":        8192,
+		"gpt-4o-mini":  128000,
+		"gpt-4.1-nano": 1047576,
+		"llama3:8b":    8192,
+		"unknown":      0,
+	}
+
+	for model, expected := range cases {
+		if actual, _ := windows.Lookup(model); actual != expected {
+			t.Errorf("Lookup(%s) = %d, expected %d", model, actual, expected)
+		}
+	}
+
+	if err := windows.CheckContextWindow("gpt-4", 8000, 192); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := windows.CheckContextWindow("gpt-4", 8000, 193); !errors.Is(err, ErrContextWindowExceeded) {
+		t.Errorf("expected %v, got %v", ErrContextWindowExceeded, err)
+	}
+	if err := windows.CheckContextWindow("unknown", 1<<30, 0); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,190 @@
+package chatfile
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrInvalidTruncatePolicy = errors.New("parser: invalid truncate policy, expected `oldest`, `keep FIRST LAST` or `summarize FIRST LAST [MODEL]`")
+)
+
+// Summarizer condenses a part of a conversation into a single text using the given model.
+type Summarizer func(model ModelName, messages []Message) (string, error)
+
+// TruncatePolicy shortens a history that does not fit the model's context window.
+type TruncatePolicy interface {
+	// Truncate returns the messages to send and the indices of the dropped ones.
+	// fits reports whether a candidate list of messages fits the context window.
+	Truncate(messages []Message, fits func([]Message) bool, summarize Summarizer) ([]Message, []int, error)
+}
+
+// DropOldest drops the oldest ASK/ANSWER pairs until the history fits.
+// System messages and the last message are always kept.
+type DropOldest struct{}
+
+func (DropOldest) Truncate(messages []Message, fits func([]Message) bool, _ Summarizer) ([]Message, []int, error) {
+	dropped := make(map[int]bool)
+	kept := messages
+
+	for i := 0; i < len(messages)-1 && !fits(kept); i++ {
+		if messages[i].Role == RoleSystem {
+			continue
+		}
+
+		dropped[i] = true
+		if i+1 < len(messages)-1 && messages[i].Role == RoleUser && messages[i+1].Role == RoleAssistant {
+			i++
+			dropped[i] = true
+		}
+
+		kept = keepMessages(messages, dropped)
+	}
+
+	return kept, sortedKeys(dropped), nil
+}
+
+// KeepTurns keeps the first and the last turns of the conversation together with system messages.
+// A turn is a question together with the answers following it, so a question never loses its answer.
+type KeepTurns struct {
+	First int
+	Last  int
+}
+
+func (p KeepTurns) Truncate(messages []Message, _ func([]Message) bool, _ Summarizer) ([]Message, []int, error) {
+	dropped := p.middle(messages)
+	return keepMessages(messages, dropped), sortedKeys(dropped), nil
+}
+
+// middle selects turns between the first and the last ones, skipping system messages.
+// The very last turn is never selected, as it is the one waiting for an answer.
+func (p KeepTurns) middle(messages []Message) map[int]bool {
+	var turns [][]int
+	for i, message := range messages {
+		switch {
+		case message.Role == RoleSystem:
+			continue
+		case message.Role == RoleUser || len(turns) == 0:
+			turns = append(turns, []int{i})
+		default:
+			turns[len(turns)-1] = append(turns[len(turns)-1], i)
+		}
+	}
+
+	dropped := make(map[int]bool)
+	for j := p.First; j < len(turns)-max(p.Last, 1); j++ {
+		for _, i := range turns[j] {
+			dropped[i] = true
+		}
+	}
+	return dropped
+}
+
+// Summarize works as [KeepTurns], but replaces the dropped turns with their summary
+// written by a secondary model. An empty Model means the model of the chatfile.
+type Summarize struct {
+	KeepTurns
+	Model ModelName
+}
+
+func (p Summarize) Truncate(messages []Message, _ func([]Message) bool, summarize Summarizer) ([]Message, []int, error) {
+	dropped := p.middle(messages)
+	if len(dropped) == 0 {
+		return messages, nil, nil
+	}
+
+	indices := sortedKeys(dropped)
+	middle := make([]Message, 0, len(indices))
+	for _, i := range indices {
+		middle = append(middle, messages[i])
+	}
+
+	summary, err := summarize(p.Model, middle)
+	if err != nil {
+		return nil, nil, fmt.Errorf("truncate: failed to summarize: %w", err)
+	}
+
+	kept := make([]Message, 0, len(messages)-len(indices)+1)
+	for i, message := range messages {
+		if i == indices[0] {
+			kept = append(kept, Message{Role: RoleSystem, Content: "Summary of the earlier conversation:\n" + summary})
+		}
+		if !dropped[i] {
+			kept = append(kept, message)
+		}
+	}
+
+	return kept, indices, nil
+}
+
+// ParseTruncatePolicy reads the arguments of a TRUNCATE command or the --truncate option.
+func ParseTruncatePolicy(arguments string) (TruncatePolicy, error) {
+	fields := strings.Fields(arguments)
+	if len(fields) == 0 {
+		return nil, ErrInvalidTruncatePolicy
+	}
+
+	switch strings.ToLower(fields[0]) {
+	case "oldest":
+		if len(fields) != 1 {
+			return nil, ErrInvalidTruncatePolicy
+		}
+		return DropOldest{}, nil
+
+	case "keep":
+		if len(fields) != 3 {
+			return nil, ErrInvalidTruncatePolicy
+		}
+		return parseKeepTurns(fields[1], fields[2])
+
+	case "summarize":
+		if len(fields) != 3 && len(fields) != 4 {
+			return nil, ErrInvalidTruncatePolicy
+		}
+
+		keep, err := parseKeepTurns(fields[1], fields[2])
+		if err != nil {
+			return nil, err
+		}
+
+		policy := Summarize{KeepTurns: keep}
+		if len(fields) == 4 {
+			policy.Model = ModelName(fields[3])
+		}
+		return policy, nil
+	}
+
+	return nil, ErrInvalidTruncatePolicy
+}
+
+func parseKeepTurns(first string, last string) (KeepTurns, error) {
+	f, err1 := strconv.Atoi(first)
+	l, err2 := strconv.Atoi(last)
+	if err1 != nil || err2 != nil || f < 0 || l < 0 {
+		return KeepTurns{}, ErrInvalidTruncatePolicy
+	}
+
+	return KeepTurns{f, l}, nil
+}
+
+func keepMessages(messages []Message, dropped map[int]bool) []Message {
+	kept := make([]Message, 0, len(messages)-len(dropped))
+	for i, message := range messages {
+		if !dropped[i] {
+			kept = append(kept, message)
+		}
+	}
+	return kept
+}
+
+func sortedKeys(set map[int]bool) []int {
+	keys := make([]int, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
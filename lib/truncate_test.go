@@ -0,0 +1,85 @@
+package chatfile
+
+import (
+	"slices"
+	"testing"
+)
+
+func testConversation() []Message {
+	return []Message{
+		{Role: RoleSystem, Content: "system"},
+		{Role: RoleUser, Content: "ask 1"},
+		{Role: RoleAssistant, Content: "answer 1"},
+		{Role: RoleUser, Content: "ask 2"},
+		{Role: RoleAssistant, Content: "answer 2"},
+		{Role: RoleUser, Content: "ask 3"},
+	}
+}
+
+func contents(messages []Message) []string {
+	var result []string
+	for _, message := range messages {
+		result = append(result, message.Content)
+	}
+	return result
+}
+
+func TestDropOldest(t *testing.T) {
+	fits := func(messages []Message) bool { return len(messages) <= 5 }
+
+	kept, dropped, err := DropOldest{}.Truncate(testConversation(), fits, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := []string{"system", "ask 2", "answer 2", "ask 3"}; !slices.Equal(contents(kept), expected) {
+		t.Errorf("kept %v, expected %v", contents(kept), expected)
+	}
+	if expected := []int{1, 2}; !slices.Equal(dropped, expected) {
+		t.Errorf("dropped %v, expected %v", dropped, expected)
+	}
+}
+
+func TestKeepTurns(t *testing.T) {
+	kept, dropped, _ := KeepTurns{1, 1}.Truncate(testConversation(), nil, nil)
+
+	if expected := []string{"system", "ask 1", "answer 1", "ask 3"}; !slices.Equal(contents(kept), expected) {
+		t.Errorf("kept %v, expected %v", contents(kept), expected)
+	}
+	if expected := []int{3, 4}; !slices.Equal(dropped, expected) {
+		t.Errorf("dropped %v, expected %v", dropped, expected)
+	}
+
+	kept, dropped, _ = KeepTurns{1, 2}.Truncate(testConversation(), nil, nil)
+	if len(dropped) != 0 || len(kept) != len(testConversation()) {
+		t.Errorf("kept %v, expected the whole conversation", contents(kept))
+	}
+
+	kept, _, _ = KeepTurns{0, 0}.Truncate(testConversation(), nil, nil)
+	if expected := []string{"system", "ask 3"}; !slices.Equal(contents(kept), expected) {
+		t.Errorf("kept %v, expected %v", contents(kept), expected)
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	var summarized []string
+	summarize := func(model ModelName, messages []Message) (string, error) {
+		if model != "small" {
+			t.Errorf("unexpected model %s", model)
+		}
+		summarized = contents(messages)
+		return "summary", nil
+	}
+
+	kept, _, err := Summarize{KeepTurns{1, 1}, "small"}.Truncate(testConversation(), nil, summarize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := []string{"ask 2", "answer 2"}; !slices.Equal(summarized, expected) {
+		t.Errorf("summarized %v, expected %v", summarized, expected)
+	}
+	if len(kept) != 5 || kept[3].Role != RoleSystem || kept[4].Content != "ask 3" {
+		t.Errorf("unexpected history %v", kept)
+	}
+}
@@ -0,0 +1,31 @@
+package chatfile
+
+import (
+	"errors"
+	"regexp"
+)
+
+var (
+	ErrInvalidVariableName = errors.New("parser: variable name must start with a letter or underscore and contain only letters, digits and underscores")
+)
+
+var (
+	variableName      = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	variableReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+)
+
+// ExpandVariables replaces ${name} references with the values of the variables.
+// References to undefined variables are kept as they are, so prompts may still contain such text literally.
+func ExpandVariables(text string, variables map[string]string) string {
+	if len(variables) == 0 {
+		return text
+	}
+
+	return variableReference.ReplaceAllStringFunc(text, func(reference string) string {
+		name := reference[2 : len(reference)-1]
+		if value, found := variables[name]; found {
+			return value
+		}
+		return reference
+	})
+}
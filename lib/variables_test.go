@@ -0,0 +1,49 @@
+package chatfile
+
+import "testing"
+
+func TestExpandVariables(t *testing.T) {
+	variables := map[string]string{"name": "Alice", "topic": "${name}"}
+
+	cases := map[string]string{
+		"Hello, ${name}!":        "Hello, Alice!",
+		"${name} and ${unknown}": "Alice and ${unknown}",
+		"$name and {name}":       "$name and {name}",
+		"${topic}":               "${name}",
+		"${ name }":              "${ name }",
+	}
+
+	for text, expected := range cases {
+		if actual := ExpandVariables(text, variables); actual != expected {
+			t.Errorf("ExpandVariables(%q) = %q, expected %q", text, actual, expected)
+		}
+	}
+}
+
+func TestVarArguments(t *testing.T) {
+	ctx := &Context{
+		History:   &OpenAiHistory{},
+		Variables: map[string]string{"language": "German"},
+		Arguments: []string{"Hallo", "Welt", "formal", "!"},
+	}
+
+	for _, command := range []Command{
+		&VarCommand{"text", "Hello"},
+		&VarCommand{"language", "English"},
+		&VarCommand{"suffix", ""},
+		&VarCommand{"tone", "polite"},
+	} {
+		command.Apply(ctx)
+	}
+
+	expected := map[string]string{"text": "Hallo", "language": "German", "suffix": "Welt", "tone": "formal"}
+	for name, value := range expected {
+		if ctx.Variables[name] != value {
+			t.Errorf("variable %s = %q, expected %q", name, ctx.Variables[name], value)
+		}
+	}
+
+	if len(ctx.Arguments) != 1 || ctx.Arguments[0] != "!" {
+		t.Errorf("arguments left = %v, expected [!]", ctx.Arguments)
+	}
+}